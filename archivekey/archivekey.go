@@ -0,0 +1,362 @@
+package archivekey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+const (
+	// The layout archives are stored with unless a template is configured. The prefix is empty unless one is
+	// configured. Older versions of frosty separated the time with colons, which S3 compatible stores, sync tools and
+	// Windows paths don't all allow, and keys in that layout are still parsed.
+	DEFAULT_TEMPLATE = "{{.Prefix}}{{.Hostname}}/{{.JobName}}/{{.Year}}{{.Month}}{{.Day}}/{{.Hour}}{{.Minute}}{{.Second}}_{{.FileName}}"
+	// The format run IDs are created in, which is used to find when an archive was created if its key has no date.
+	RUN_ID_FORMAT = "20060102150405"
+)
+
+// The patterns that each variable matches when a key is parsed. The prefix is matched literally.
+var variablePatterns = map[string]string{
+	"Hostname": `[^/]+?`,
+	"JobName":  `[^/]+?`,
+	"RunId":    `\d{14}`,
+	"FileName": `[^/]+?`,
+	"Year":     `\d{4}`,
+	"Month":    `\d{2}`,
+	"Day":      `\d{2}`,
+	"Hour":     `\d{2}`,
+	"Minute":   `\d{2}`,
+	"Second":   `\d{2}`,
+}
+
+// The variables whose values may be any length. Keys can only be split into their values if these are separated by a
+// "/", which none of their values contain.
+var unboundedVariables = map[string]bool{
+	"Hostname": true,
+	"JobName":  true,
+	"FileName": true,
+}
+
+// What an archive's key is made from.
+type Values struct {
+	Hostname  string
+	JobName   string
+	RunId     string
+	FileName  string
+	CreatedAt time.Time
+}
+
+// The variables available within a template.
+type variables struct {
+	Prefix   string
+	Hostname string
+	JobName  string
+	RunId    string
+	FileName string
+	Year     string
+	Month    string
+	Day      string
+	Hour     string
+	Minute   string
+	Second   string
+}
+
+// A template for the keys archives are stored under, e.g. S3 object keys. Templates may only contain text and
+// variables so that keys can be parsed back into the values they were made from.
+type Template struct {
+	prefix string
+	tmpl   *template.Template
+	// The text of each part of the template in order. Parts that are a variable hold its name and isVariable is set.
+	parts      []string
+	isVariable []bool
+	pattern    *regexp.Regexp
+	// The name of the variable matched by each of the pattern's capture groups.
+	groups []string
+	// Whether the template contains the run ID and every part of the date and time.
+	hasRunId bool
+	hasDate  bool
+}
+
+// Create a template from its text, which uses Go template syntax, and the prefix given to it as {{.Prefix}}. An empty
+// text uses the default template. The template must contain the hostname, job name and file name along with either
+// every part of the date and time or the run ID so that archives can be found and restored, and no two of the hostname,
+// job name and file name may be between the same pair of "/" as a key could then be split in more than one way.
+func New(text string, prefix string) (*Template, error) {
+	if text == "" {
+		text = DEFAULT_TEMPLATE
+	}
+
+	tmpl, err := template.New("key").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	kt := &Template{
+		prefix: prefix,
+		tmpl:   tmpl,
+	}
+
+	found := make(map[string]bool)
+	pattern := "^"
+	// The unbounded variable in the part of the template since the last "/", if there is one.
+	unbounded := ""
+
+	for _, node := range tmpl.Tree.Root.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			kt.parts = append(kt.parts, string(n.Text))
+			kt.isVariable = append(kt.isVariable, false)
+			pattern += regexp.QuoteMeta(string(n.Text))
+			if strings.Contains(string(n.Text), "/") {
+				unbounded = ""
+			}
+		case *parse.ActionNode:
+			name, ok := getVariableName(n)
+			if !ok {
+				return nil, fmt.Errorf("key templates may only contain text and variables such as {{.JobName}} - found %s", n)
+			}
+			kt.parts = append(kt.parts, name)
+			kt.isVariable = append(kt.isVariable, true)
+			found[name] = true
+
+			if unboundedVariables[name] {
+				if unbounded != "" {
+					return nil, fmt.Errorf("key templates must have a / between {{.%s}} and {{.%s}} so that keys can only be split into them one way", unbounded, name)
+				}
+				unbounded = name
+			}
+
+			if name == "Prefix" {
+				pattern += regexp.QuoteMeta(prefix)
+				if strings.Contains(prefix, "/") {
+					unbounded = ""
+				}
+			} else {
+				pattern += "(" + variablePatterns[name] + ")"
+				kt.groups = append(kt.groups, name)
+			}
+		default:
+			return nil, fmt.Errorf("key templates may only contain text and variables such as {{.JobName}} - found %s", n)
+		}
+	}
+
+	if !found["Hostname"] || !found["JobName"] || !found["FileName"] {
+		return nil, errors.New("key templates must contain {{.Hostname}}, {{.JobName}} and {{.FileName}}")
+	}
+	if !found["RunId"] && !(found["Year"] && found["Month"] && found["Day"] && found["Hour"] && found["Minute"] && found["Second"]) {
+		return nil, errors.New("key templates must contain either {{.RunId}} or all of {{.Year}}, {{.Month}}, {{.Day}}, {{.Hour}}, {{.Minute}} and {{.Second}}")
+	}
+
+	kt.hasRunId = found["RunId"]
+	kt.hasDate = found["Year"] && found["Month"] && found["Day"] && found["Hour"] && found["Minute"] && found["Second"]
+
+	kt.pattern, err = regexp.Compile(pattern + "$")
+	if err != nil {
+		return nil, err
+	}
+
+	return kt, nil
+}
+
+// Get the key for an archive. Returns an error if the key would not be parsed back into the same values, e.g. because
+// one of them contains a "/", as the archive would then be listed and pruned as though it were another.
+func (kt *Template) Key(values Values) (string, error) {
+	t := values.CreatedAt
+
+	vars := variables{
+		Prefix:   kt.prefix,
+		Hostname: values.Hostname,
+		JobName:  values.JobName,
+		RunId:    values.RunId,
+		FileName: values.FileName,
+		Year:     t.Format("2006"),
+		Month:    t.Format("01"),
+		Day:      t.Format("02"),
+		Hour:     t.Format("15"),
+		Minute:   t.Format("04"),
+		Second:   t.Format("05"),
+	}
+
+	var buf bytes.Buffer
+	err := kt.tmpl.Execute(&buf, vars)
+	if err != nil {
+		return "", err
+	}
+	key := buf.String()
+
+	parsed, ok := kt.parseKey(key)
+	if !ok || parsed.Hostname != values.Hostname || parsed.JobName != values.JobName || parsed.FileName != values.FileName {
+		return "", fmt.Errorf("the key %q would not be parsed back into the hostname %q, job name %q and file name %q", key, values.Hostname, values.JobName, values.FileName)
+	}
+	if kt.hasRunId && parsed.RunId != values.RunId {
+		return "", fmt.Errorf("the key %q would not be parsed back into the run ID %q", key, values.RunId)
+	}
+	createdAt := values.RunId
+	if kt.hasDate {
+		createdAt = t.Format(RUN_ID_FORMAT)
+	}
+	if parsed.CreatedAt.Format(RUN_ID_FORMAT) != createdAt {
+		return "", fmt.Errorf("the key %q would not be parsed back into the time %s", key, createdAt)
+	}
+
+	return key, nil
+}
+
+// Parse a key back into the values it was made from. Keys in the default layout, including those stored by older
+// versions of frosty that did not include the job name or separated the time with colons, are also accepted so that
+// archives stored before the template was changed can still be found. Returns false if the key is in neither and so
+// was not stored by frosty.
+func (kt *Template) Parse(key string) (Values, bool) {
+	values, ok := kt.parseKey(key)
+	if !ok {
+		return parseDefaultKey(key)
+	}
+
+	return values, true
+}
+
+// Parse a key made from this template back into the values it was made from.
+func (kt *Template) parseKey(key string) (Values, bool) {
+	match := kt.pattern.FindStringSubmatch(key)
+	if match == nil {
+		return Values{}, false
+	}
+
+	matched := make(map[string]string)
+	for i, name := range kt.groups {
+		// A variable used more than once must have the same value each time.
+		if v, ok := matched[name]; ok && v != match[i+1] {
+			return Values{}, false
+		}
+		matched[name] = match[i+1]
+	}
+
+	// The run ID gives the time if the template only has part of the date, e.g. just the year and month.
+	var createdAt time.Time
+	var err error
+	if kt.hasDate {
+		createdAt, err = time.ParseInLocation(RUN_ID_FORMAT, matched["Year"]+matched["Month"]+matched["Day"]+matched["Hour"]+matched["Minute"]+matched["Second"], time.Local)
+	} else {
+		createdAt, err = time.ParseInLocation(RUN_ID_FORMAT, matched["RunId"], time.Local)
+	}
+	if err != nil {
+		return Values{}, false
+	}
+
+	return Values{
+		Hostname:  matched["Hostname"],
+		JobName:   matched["JobName"],
+		RunId:     matched["RunId"],
+		FileName:  matched["FileName"],
+		CreatedAt: createdAt,
+	}, true
+}
+
+// Get the start shared by the keys of every archive stored for a host, e.g. to list them. This is empty if the
+// template does not start with the hostname.
+func (kt *Template) HostPrefix(hostname string) string {
+	prefix, _ := kt.leadingText(hostname, "")
+	return prefix
+}
+
+// Get the start shared by the keys of every archive stored for a job on a host, and whether it includes the job name.
+// If it does not then archives of other jobs share the same prefix.
+func (kt *Template) JobPrefix(hostname string, jobName string) (string, bool) {
+	return kt.leadingText(hostname, jobName)
+}
+
+// Render the template up to the first variable that is not known, returning whether the job name was included. The
+// job name is only known if it is given.
+func (kt *Template) leadingText(hostname string, jobName string) (string, bool) {
+	var sb strings.Builder
+	includesJobName := false
+
+	for i, part := range kt.parts {
+		if !kt.isVariable[i] {
+			sb.WriteString(part)
+			continue
+		}
+
+		switch {
+		case part == "Prefix":
+			sb.WriteString(kt.prefix)
+		case part == "Hostname":
+			sb.WriteString(hostname)
+		case part == "JobName" && jobName != "":
+			sb.WriteString(jobName)
+			includesJobName = true
+		default:
+			return sb.String(), includesJobName
+		}
+	}
+
+	return sb.String(), includesJobName
+}
+
+// Get the name of the variable an action such as {{.JobName}} refers to. Returns false if the action is anything
+// other than a single known variable.
+func getVariableName(n *parse.ActionNode) (string, bool) {
+	if len(n.Pipe.Decl) != 0 || len(n.Pipe.Cmds) != 1 || len(n.Pipe.Cmds[0].Args) != 1 {
+		return "", false
+	}
+
+	field, ok := n.Pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	if !ok || len(field.Ident) != 1 {
+		return "", false
+	}
+
+	name := field.Ident[0]
+	if _, ok := variablePatterns[name]; !ok && name != "Prefix" {
+		return "", false
+	}
+
+	return name, true
+}
+
+// Parse a key in the default layout without a prefix. Keys stored by older versions of frosty as
+// hostname/date/time_filename, without the job name, are also accepted and take the job name from the file name, as
+// are those with the time separated by colons.
+func parseDefaultKey(key string) (Values, bool) {
+	parts := strings.Split(key, "/")
+
+	var hostname, jobName, date, timeAndFileName string
+	switch len(parts) {
+	case 3:
+		hostname, date, timeAndFileName = parts[0], parts[1], parts[2]
+	case 4:
+		hostname, jobName, date, timeAndFileName = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return Values{}, false
+	}
+
+	tf := strings.SplitN(timeAndFileName, "_", 2)
+	if len(tf) != 2 {
+		return Values{}, false
+	}
+
+	createdAt, err := time.ParseInLocation("20060102 150405", date+" "+tf[0], time.Local)
+	if err != nil {
+		createdAt, err = time.ParseInLocation("20060102 15:04:05", date+" "+tf[0], time.Local)
+	}
+	if err != nil {
+		return Values{}, false
+	}
+
+	fileName := tf[1]
+	if jobName == "" {
+		jobName = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+
+	return Values{
+		Hostname:  hostname,
+		JobName:   jobName,
+		FileName:  fileName,
+		CreatedAt: createdAt,
+	}, true
+}
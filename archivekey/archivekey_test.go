@@ -0,0 +1,168 @@
+package archivekey
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		prefix   string
+		errorHas string
+	}{
+		{"default", "", "", ""},
+		{"run ID", "{{.Hostname}}/{{.JobName}}/{{.RunId}}_{{.FileName}}", "", ""},
+		{"prefix", "{{.Prefix}}{{.Hostname}}/{{.JobName}}/{{.RunId}}_{{.FileName}}", "backups/", ""},
+		{"prefix separating variables", "{{.Hostname}}{{.Prefix}}{{.JobName}}/{{.RunId}}_{{.FileName}}", "/jobs/", ""},
+		{"hostname and job name together", "{{.Hostname}}-{{.JobName}}/{{.RunId}}_{{.FileName}}", "", "between {{.Hostname}} and {{.JobName}}"},
+		{"job name and file name together", "{{.Hostname}}/{{.JobName}}_{{.RunId}}_{{.FileName}}", "", "between {{.JobName}} and {{.FileName}}"},
+		{"prefix without a slash", "{{.Hostname}}{{.Prefix}}{{.JobName}}/{{.RunId}}_{{.FileName}}", "-", "between {{.Hostname}} and {{.JobName}}"},
+		{"no job name", "{{.Hostname}}/{{.RunId}}_{{.FileName}}", "", "must contain {{.Hostname}}, {{.JobName}} and {{.FileName}}"},
+		{"no time", "{{.Hostname}}/{{.JobName}}/{{.Year}}{{.Month}}{{.Day}}/{{.FileName}}", "", "either {{.RunId}} or all of"},
+		{"function", `{{.Hostname}}/{{.JobName}}/{{.RunId}}_{{printf "%s" .FileName}}`, "", "only contain text and variables"},
+		{"unknown variable", "{{.Hostname}}/{{.JobName}}/{{.RunId}}_{{.Host}}", "", "only contain text and variables"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.text, tt.prefix)
+			if tt.errorHas == "" {
+				if err != nil {
+					t.Fatalf("New(%q) returned an error: %s", tt.text, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorHas) {
+				t.Fatalf("New(%q) returned error %v, want one containing %q", tt.text, err, tt.errorHas)
+			}
+		})
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	values := Values{
+		Hostname:  "web-01",
+		JobName:   "postgres_dump",
+		RunId:     "20170130140509",
+		FileName:  "postgres_dump.tar.gz",
+		CreatedAt: time.Date(2017, 1, 30, 14, 5, 9, 0, time.Local),
+	}
+
+	tests := []struct {
+		name   string
+		text   string
+		prefix string
+		key    string
+	}{
+		{"default", "", "", "web-01/postgres_dump/20170130/140509_postgres_dump.tar.gz"},
+		{"default with prefix", "", "backups/", "backups/web-01/postgres_dump/20170130/140509_postgres_dump.tar.gz"},
+		{"run ID", "{{.JobName}}/{{.Hostname}}/{{.RunId}}-{{.FileName}}", "", "postgres_dump/web-01/20170130140509-postgres_dump.tar.gz"},
+		{"date and run ID", "{{.Year}}/{{.Month}}/{{.Day}}/{{.Hostname}}/{{.JobName}}/{{.RunId}}/{{.FileName}}", "", "2017/01/30/web-01/postgres_dump/20170130140509/postgres_dump.tar.gz"},
+		{"repeated variable", "{{.Hostname}}/{{.JobName}}/{{.RunId}}/{{.JobName}}_{{.Hour}}{{.Minute}}{{.Second}}/{{.FileName}}", "", "web-01/postgres_dump/20170130140509/postgres_dump_140509/postgres_dump.tar.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kt, err := New(tt.text, tt.prefix)
+			if err != nil {
+				t.Fatalf("New(%q) returned an error: %s", tt.text, err)
+			}
+
+			key, err := kt.Key(values)
+			if err != nil {
+				t.Fatalf("Key returned an error: %s", err)
+			}
+			if key != tt.key {
+				t.Fatalf("Key returned %q, want %q", key, tt.key)
+			}
+
+			parsed, ok := kt.Parse(key)
+			if !ok {
+				t.Fatalf("Parse(%q) did not match the template", key)
+			}
+			if parsed.Hostname != values.Hostname || parsed.JobName != values.JobName || parsed.FileName != values.FileName {
+				t.Errorf("Parse(%q) returned %+v, want %+v", key, parsed, values)
+			}
+			if !parsed.CreatedAt.Equal(values.CreatedAt) {
+				t.Errorf("Parse(%q) returned a creation time of %s, want %s", key, parsed.CreatedAt, values.CreatedAt)
+			}
+		})
+	}
+}
+
+func TestKeyRejectsValuesThatDoNotRoundTrip(t *testing.T) {
+	values := Values{
+		Hostname:  "web-01",
+		JobName:   "postgres",
+		RunId:     "20170130140509",
+		FileName:  "postgres.zip",
+		CreatedAt: time.Date(2017, 1, 30, 14, 5, 9, 0, time.Local),
+	}
+
+	tests := []struct {
+		name   string
+		text   string
+		modify func(v *Values)
+	}{
+		{"slash in hostname", "", func(v *Values) { v.Hostname = "web/01" }},
+		{"slash in job name", "", func(v *Values) { v.JobName = "db/postgres" }},
+		{"empty file name", "", func(v *Values) { v.FileName = "" }},
+		{"run ID not a time", "{{.Hostname}}/{{.JobName}}/{{.RunId}}_{{.FileName}}", func(v *Values) { v.RunId = "run-1" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kt, err := New(tt.text, "")
+			if err != nil {
+				t.Fatalf("New(%q) returned an error: %s", tt.text, err)
+			}
+
+			v := values
+			tt.modify(&v)
+			key, err := kt.Key(v)
+			if err == nil {
+				t.Fatalf("Key(%+v) returned %q, want an error", v, key)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	createdAt := time.Date(2017, 1, 30, 14, 5, 9, 0, time.Local)
+
+	tests := []struct {
+		name string
+		text string
+		key  string
+		want Values
+		ok   bool
+	}{
+		{"default", "", "web-01/postgres/20170130/140509_postgres.zip", Values{Hostname: "web-01", JobName: "postgres", FileName: "postgres.zip", CreatedAt: createdAt}, true},
+		{"time with colons", "", "web-01/postgres/20170130/14:05:09_postgres.zip", Values{Hostname: "web-01", JobName: "postgres", FileName: "postgres.zip", CreatedAt: createdAt}, true},
+		{"no job name", "", "web-01/20170130/14:05:09_postgres.zip", Values{Hostname: "web-01", JobName: "postgres", FileName: "postgres.zip", CreatedAt: createdAt}, true},
+		{"default layout with another template", "{{.Hostname}}/{{.JobName}}/{{.RunId}}_{{.FileName}}", "web-01/postgres/20170130/140509_postgres.zip", Values{Hostname: "web-01", JobName: "postgres", FileName: "postgres.zip", CreatedAt: createdAt}, true},
+		{"bad date", "", "web-01/postgres/20171330/140509_postgres.zip", Values{}, false},
+		{"no time", "", "web-01/postgres/20170130/postgres.zip", Values{}, false},
+		{"too deep", "", "a/web-01/postgres/20170130/140509_postgres.zip", Values{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kt, err := New(tt.text, "")
+			if err != nil {
+				t.Fatalf("New(%q) returned an error: %s", tt.text, err)
+			}
+
+			got, ok := kt.Parse(tt.key)
+			if ok != tt.ok {
+				t.Fatalf("Parse(%q) returned ok %t, want %t", tt.key, ok, tt.ok)
+			}
+			if got.Hostname != tt.want.Hostname || got.JobName != tt.want.JobName || got.FileName != tt.want.FileName || !got.CreatedAt.Equal(tt.want.CreatedAt) {
+				t.Errorf("Parse(%q) returned %+v, want %+v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,15 +1,33 @@
 package artifact
 
 import (
-	"archive/zip"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mleonard87/frosty/config"
 )
 
-func MakeArtifactArchive(artifactDir string, target string) (bool, error) {
+// Use the default compression level for the archive format.
+const DEFAULT_COMPRESSION_LEVEL = -1
+
+// A symlink in an archive being extracted. These are created once every other entry has been extracted so that no
+// entry can be written through a symlink from the same archive.
+type extractedSymlink struct {
+	Name     string
+	Target   string
+	Linkname string
+	Uid      int
+	Gid      int
+	HasOwner bool
+}
+
+// Archive every file, directory and symlink in artifactDir into a new archive at target in the given format. Returns
+// false if there were no artifacts to archive.
+func MakeArtifactArchive(artifactDir string, target string, format string, compressionLevel int) (bool, error) {
 	artifactFiles, err := listArtifactFiles(artifactDir, target)
 	if err != nil {
 		return false, err
@@ -19,7 +37,15 @@ func MakeArtifactArchive(artifactDir string, target string) (bool, error) {
 		return false, nil
 	}
 
-	err = makeZipFromFiles(target, artifactFiles, artifactDir)
+	switch format {
+	case config.ARCHIVE_FORMAT_ZIP:
+		err = makeZipFromFiles(target, artifactFiles, artifactDir, compressionLevel)
+	case config.ARCHIVE_FORMAT_TAR_GZ, config.ARCHIVE_FORMAT_TAR_ZST:
+		err = makeTarFromFiles(target, artifactFiles, artifactDir, format, compressionLevel)
+	default:
+		err = fmt.Errorf("Unknown archive format %q.", format)
+	}
+
 	if err != nil {
 		return false, err
 	}
@@ -27,15 +53,37 @@ func MakeArtifactArchive(artifactDir string, target string) (bool, error) {
 	return true, nil
 }
 
+// Extract all of the files in the archive at archivePath into targetDir, creating any directories needed. The format
+// of the archive is determined by its file extension.
+func ExtractArtifactArchive(archivePath string, targetDir string) error {
+	// Entries are checked against the absolute path of the target so that relative targets such as "." work.
+	targetDir, err := filepath.Abs(targetDir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case strings.HasSuffix(archivePath, "."+config.ARCHIVE_FORMAT_ZIP):
+		return extractZip(archivePath, targetDir)
+	case strings.HasSuffix(archivePath, "."+config.ARCHIVE_FORMAT_TAR_GZ):
+		return extractTar(archivePath, targetDir, config.ARCHIVE_FORMAT_TAR_GZ)
+	case strings.HasSuffix(archivePath, "."+config.ARCHIVE_FORMAT_TAR_ZST):
+		return extractTar(archivePath, targetDir, config.ARCHIVE_FORMAT_TAR_ZST)
+	default:
+		return fmt.Errorf("Unable to determine the format of archive %q.", archivePath)
+	}
+}
+
 func listArtifactFiles(artifactDir string, target string) ([]string, error) {
 	var artifactFiles []string
 
+	// Walk does not follow symlinks so they are listed as links rather than the files they point to.
 	err := filepath.Walk(artifactDir, func(path string, f os.FileInfo, err error) error {
-		id, err := isDirectory(path)
 		if err != nil {
-			return err
+			em := fmt.Sprintf("Error listing artifact \"%s\":\n%s\n", path, err)
+			return errors.New(em)
 		}
-		if path != artifactDir && !id && path != target {
+		if path != artifactDir && path != target {
 			artifactFiles = append(artifactFiles, path)
 		}
 		return nil
@@ -48,51 +96,132 @@ func listArtifactFiles(artifactDir string, target string) ([]string, error) {
 	return artifactFiles, nil
 }
 
-func isDirectory(path string) (bool, error) {
-	fileInfo, err := os.Stat(path)
+// Get the name of a file within an archive relative to the directory being archived.
+func archiveEntryName(file string, basePath string, isDir bool) (string, error) {
+	relativeFileName, err := filepath.Rel(basePath, file)
 	if err != nil {
+		return "", err
+	}
+
+	name := filepath.ToSlash(relativeFileName)
+	if isDir {
+		name += "/"
+	}
+
+	return name, nil
+}
+
+// Get the path to extract an archive entry to, refusing anything that would be written outside of the target directory
+// either by its name or through a symlink in the directories above it. The target directory must be an absolute path.
+// Entries for the target directory itself, such as "./", are allowed.
+func extractPath(targetDir string, name string) (string, error) {
+	target := filepath.Join(targetDir, filepath.FromSlash(name))
+
+	if !isWithinDirectory(targetDir, target) {
+		return "", fmt.Errorf("Illegal file path in archive: %s", name)
+	}
+	if target == targetDir {
+		return target, nil
+	}
+
+	// Check each directory between the target directory and the entry, stopping at the first that doesn't exist yet as
+	// it and those below it will be created as directories.
+	rel, _ := filepath.Rel(targetDir, filepath.Dir(target))
+	dir := targetDir
+	for _, component := range strings.Split(rel, string(os.PathSeparator)) {
+		if component == "." {
+			continue
+		}
+		dir = filepath.Join(dir, component)
+
+		fi, err := os.Lstat(dir)
 		if os.IsNotExist(err) {
-			return false, nil
-		} else {
-			em := fmt.Sprintf("Error determining if \"%s\" is a directory:\n%s\n", path, err)
-			return false, errors.New(em)
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Illegal file path in archive: %s is within the symlink %s", name, dir)
 		}
 	}
-	return fileInfo.IsDir(), nil
+
+	return target, nil
 }
 
-func makeZipFromFiles(target string, sourceFileList []string, basePath string) error {
-	zipfile, err := os.Create(target)
-	if err != nil {
-		return err
+// Whether path is dir or within it. Both must be clean, absolute paths.
+func isWithinDirectory(dir string, path string) bool {
+	prefix := dir
+	if !strings.HasSuffix(prefix, string(os.PathSeparator)) {
+		prefix += string(os.PathSeparator)
 	}
-	defer zipfile.Close()
 
-	// Create a new zip archive.
-	w := zip.NewWriter(zipfile)
-	defer w.Close()
+	return path == dir || strings.HasPrefix(path, prefix)
+}
+
+// Create the symlinks from an archive once everything else in it has been extracted, refusing any that point outside of
+// the target directory.
+func extractSymlinks(targetDir string, symlinks []extractedSymlink) error {
+	for _, s := range symlinks {
+		linkTarget := filepath.FromSlash(s.Linkname)
+		if !filepath.IsAbs(linkTarget) {
+			linkTarget = filepath.Join(filepath.Dir(s.Target), linkTarget)
+		}
+		if !isWithinDirectory(targetDir, filepath.Clean(linkTarget)) {
+			return fmt.Errorf("Illegal symlink in archive: %s -> %s", s.Name, s.Linkname)
+		}
 
-	for _, file := range sourceFileList {
-		relativeFileName, err := filepath.Rel(basePath, file)
+		// Check the path again as an earlier symlink may now be in the way.
+		_, err := extractPath(targetDir, s.Name)
 		if err != nil {
 			return err
 		}
 
-		f, err := w.Create(relativeFileName)
+		err = extractSymlink(s.Target, s.Linkname)
 		if err != nil {
 			return err
 		}
 
-		fileContents, err := ioutil.ReadFile(file)
+		err = restoreMetadata(s.Target, os.ModeSymlink, time.Time{}, s.Uid, s.Gid, s.HasOwner)
 		if err != nil {
 			return err
 		}
+	}
 
-		_, err = f.Write(fileContents)
+	return nil
+}
+
+// Create a symlink at target, replacing anything already there.
+func extractSymlink(target string, linkname string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(target)
+
+	return os.Symlink(linkname, target)
+}
+
+// Restore the permissions and modification time of an extracted file or directory. Ownership is only restored when
+// running as root as nobody else is able to give files away.
+func restoreMetadata(target string, mode os.FileMode, modTime time.Time, uid int, gid int, hasOwner bool) error {
+	if hasOwner && os.Geteuid() == 0 {
+		err := os.Lchown(target, uid, gid)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	// Permissions and times can't be set on the symlink itself, only the file it points to.
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, modTime, modTime)
 }
@@ -0,0 +1,151 @@
+package artifact
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Make a directory to extract into containing a directory and a symlink to another directory outside of it.
+func makeTargetDir(t *testing.T) (string, func()) {
+	tmp, err := ioutil.TempDir("", "frosty-artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+
+	targetDir := filepath.Join(tmp, "target")
+	for _, dir := range []string{filepath.Join(targetDir, "dir"), filepath.Join(tmp, "outside")} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+
+	err = os.Symlink(filepath.Join(tmp, "outside"), filepath.Join(targetDir, "link"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return targetDir, cleanup
+}
+
+func TestExtractPath(t *testing.T) {
+	targetDir, cleanup := makeTargetDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		name  string
+		entry string
+		// The path the entry should be extracted to relative to the target directory. Empty if it is refused.
+		want string
+	}{
+		{"file", "file.txt", "file.txt"},
+		{"file in directory", "dir/file.txt", "dir/file.txt"},
+		{"target directory", "./", "."},
+		{"new directories", "new/deeper/file.txt", "new/deeper/file.txt"},
+		{"absolute", "/etc/passwd", "etc/passwd"},
+		{"dot dot within", "dir/../file.txt", "file.txt"},
+		{"parent", "../file.txt", ""},
+		{"dot dot outside", "dir/../../file.txt", ""},
+		{"through symlink", "link/file.txt", ""},
+		{"through symlink below directory", "link/new/file.txt", ""},
+		{"replacing symlink", "link", "link"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractPath(targetDir, tt.entry)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("extractPath(%q) returned %q, want an error", tt.entry, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractPath(%q) returned an error: %s", tt.entry, err)
+			}
+			if want := filepath.Join(targetDir, filepath.FromSlash(tt.want)); got != want {
+				t.Errorf("extractPath(%q) returned %q, want %q", tt.entry, got, want)
+			}
+		})
+	}
+}
+
+func TestExtractTarRejectsEscapes(t *testing.T) {
+	type entry struct {
+		name     string
+		linkname string
+	}
+
+	tests := []struct {
+		name     string
+		entries  []entry
+		errorHas string
+	}{
+		{"files", []entry{{"dir/", ""}, {"dir/file.txt", ""}}, ""},
+		{"symlink within", []entry{{"file.txt", ""}, {"dir/link", "../file.txt"}}, ""},
+		{"parent", []entry{{"../file.txt", ""}}, "Illegal file path"},
+		{"existing symlink", []entry{{"link/file.txt", ""}}, "Illegal file path"},
+		{"relative symlink outside", []entry{{"escape", "../outside"}}, "Illegal symlink"},
+		{"absolute symlink outside", []entry{{"escape", "/etc"}}, "Illegal symlink"},
+		// Symlinks are created last so a file cannot be written through one from the same archive.
+		{"file through symlink", []entry{{"escape", "../outside"}, {"escape/file.txt", ""}}, "Illegal symlink"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetDir, cleanup := makeTargetDir(t)
+			defer cleanup()
+
+			archivePath := filepath.Join(filepath.Dir(targetDir), "archive.tar.gz")
+			f, err := os.Create(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gw := gzip.NewWriter(f)
+			tw := tar.NewWriter(gw)
+			for _, e := range tt.entries {
+				header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg}
+				switch {
+				case e.linkname != "":
+					header.Typeflag = tar.TypeSymlink
+					header.Linkname = e.linkname
+				case strings.HasSuffix(e.name, "/"):
+					header.Typeflag = tar.TypeDir
+					header.Mode = 0755
+				}
+				err = tw.WriteHeader(header)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			tw.Close()
+			gw.Close()
+			f.Close()
+
+			err = ExtractArtifactArchive(archivePath, targetDir)
+			if tt.errorHas == "" {
+				if err != nil {
+					t.Fatalf("ExtractArtifactArchive returned an error: %s", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.errorHas) {
+				t.Fatalf("ExtractArtifactArchive returned error %v, want one containing %q", err, tt.errorHas)
+			}
+
+			outside, err := ioutil.ReadDir(filepath.Join(filepath.Dir(targetDir), "outside"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(outside) > 0 {
+				t.Errorf("%s was written outside of the target directory", outside[0].Name())
+			}
+		})
+	}
+}
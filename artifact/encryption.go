@@ -0,0 +1,140 @@
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"github.com/mleonard87/frosty/config"
+)
+
+// Encrypt the archive at archivePath into a new file at target using age. The archive is encrypted either with a
+// passphrase or for one or more public key recipients.
+func EncryptArtifactArchive(archivePath string, target string, encryptionConfig config.EncryptionConfig) error {
+	recipients, err := getRecipients(encryptionConfig)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	w, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	_, err = io.Copy(w, in)
+	if err != nil {
+		w.Close()
+		out.Close()
+		return err
+	}
+
+	// Closing the age writer flushes the final chunk so must happen before the file is closed.
+	err = w.Close()
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// Decrypt an archive encrypted by EncryptArtifactArchive into a new file at target. Either the passphrase or the
+// identity file in the config is used to decrypt the archive.
+func DecryptArtifactArchive(archivePath string, target string, encryptionConfig config.EncryptionConfig) error {
+	identities, err := getIdentities(encryptionConfig)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := age.Decrypt(in, identities...)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, r)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func getRecipients(encryptionConfig config.EncryptionConfig) ([]age.Recipient, error) {
+	if encryptionConfig.Passphrase != "" {
+		r, err := age.NewScryptRecipient(encryptionConfig.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	}
+
+	var recipients []age.Recipient
+
+	for _, rs := range encryptionConfig.Recipients {
+		r, err := age.ParseX25519Recipient(rs)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption recipient %q: %s", rs, err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	return recipients, nil
+}
+
+func getIdentities(encryptionConfig config.EncryptionConfig) ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if encryptionConfig.Passphrase != "" {
+		id, err := age.NewScryptIdentity(encryptionConfig.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+
+	if encryptionConfig.IdentityFile != "" {
+		f, err := os.Open(encryptionConfig.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		ids, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption identity file %q: %s", encryptionConfig.IdentityFile, err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("An encryption passphrase or identityFile must be configured to decrypt archives.")
+	}
+
+	return identities, nil
+}
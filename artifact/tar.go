@@ -0,0 +1,211 @@
+package artifact
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mleonard87/frosty/config"
+)
+
+func makeTarFromFiles(target string, sourceFileList []string, basePath string, format string, compressionLevel int) error {
+	tarfile, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer tarfile.Close()
+
+	cw, err := newCompressor(tarfile, format, compressionLevel)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(cw)
+
+	for _, file := range sourceFileList {
+		err = addTarEntry(tw, file, basePath)
+		if err != nil {
+			tw.Close()
+			cw.Close()
+			return err
+		}
+	}
+
+	// Each of the writers must be closed in turn to flush the end of the archive to disk.
+	err = tw.Close()
+	if err != nil {
+		cw.Close()
+		return err
+	}
+
+	err = cw.Close()
+	if err != nil {
+		return err
+	}
+
+	return tarfile.Close()
+}
+
+// Add a file, directory or symlink to the tar archive along with its permissions, ownership and modification time.
+// File contents are streamed from disk.
+func addTarEntry(tw *tar.Writer, file string, basePath string) error {
+	fileInfo, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+
+	// Sockets can't be stored in a tar archive and would be meaningless when restored anyway.
+	if fileInfo.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+
+	var link string
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fileInfo, link)
+	if err != nil {
+		return err
+	}
+
+	header.Name, err = archiveEntryName(file, basePath, fileInfo.IsDir())
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if !fileInfo.Mode().IsRegular() {
+		return nil
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+func extractTar(archivePath string, targetDir string, format string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := newDecompressor(f, format)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+
+	var dirs []*tar.Header
+	var symlinks []extractedSymlink
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := extractPath(targetDir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			err = writeExtractedFile(target, tr)
+		case tar.TypeSymlink:
+			symlinks = append(symlinks, extractedSymlink{
+				Name:     header.Name,
+				Target:   target,
+				Linkname: header.Linkname,
+				Uid:      header.Uid,
+				Gid:      header.Gid,
+				HasOwner: true,
+			})
+			continue
+		default:
+			// Devices, FIFOs and hard links are not restored.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeDir {
+			err = restoreMetadata(target, header.FileInfo().Mode(), header.ModTime, header.Uid, header.Gid, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = extractSymlinks(targetDir, symlinks)
+	if err != nil {
+		return err
+	}
+
+	// Extracting files changes the modification time of their directory so these are restored last, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(targetDir, filepath.FromSlash(dirs[i].Name))
+		err = restoreMetadata(target, dirs[i].FileInfo().Mode(), dirs[i].ModTime, dirs[i].Uid, dirs[i].Gid, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newCompressor(w io.Writer, format string, compressionLevel int) (io.WriteCloser, error) {
+	switch format {
+	case config.ARCHIVE_FORMAT_TAR_GZ:
+		return gzip.NewWriterLevel(w, compressionLevel)
+	case config.ARCHIVE_FORMAT_TAR_ZST:
+		if compressionLevel == DEFAULT_COMPRESSION_LEVEL {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel)))
+	default:
+		return nil, fmt.Errorf("Unknown archive format %q.", format)
+	}
+}
+
+func newDecompressor(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case config.ARCHIVE_FORMAT_TAR_GZ:
+		return gzip.NewReader(r)
+	case config.ARCHIVE_FORMAT_TAR_ZST:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("Unknown archive format %q.", format)
+	}
+}
@@ -0,0 +1,228 @@
+package artifact
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func makeZipFromFiles(target string, sourceFileList []string, basePath string, compressionLevel int) error {
+	zipfile, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer zipfile.Close()
+
+	// Create a new zip archive.
+	w := zip.NewWriter(zipfile)
+	w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, compressionLevel)
+	})
+
+	for _, file := range sourceFileList {
+		err = addZipEntry(w, file, basePath)
+		if err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	// The zip's central directory is only written on close so this must succeed for the archive to be readable.
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return zipfile.Close()
+}
+
+// Add a file, directory or symlink to the zip archive. File contents are streamed from disk and symlinks are stored
+// as their target path in the same way as the Info-ZIP tools. Zip archives do not hold file ownership.
+func addZipEntry(w *zip.Writer, file string, basePath string) error {
+	fileInfo, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+
+	isSymlink := fileInfo.Mode()&os.ModeSymlink != 0
+
+	// Skip anything other than regular files, directories and symlinks e.g. sockets and devices.
+	if !fileInfo.Mode().IsRegular() && !fileInfo.IsDir() && !isSymlink {
+		return nil
+	}
+
+	header, err := zip.FileInfoHeader(fileInfo)
+	if err != nil {
+		return err
+	}
+
+	header.Name, err = archiveEntryName(file, basePath, fileInfo.IsDir())
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.Mode().IsRegular() {
+		header.Method = zip.Deflate
+	}
+
+	f, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isSymlink:
+		link, err := os.Readlink(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, link)
+		return err
+	case fileInfo.Mode().IsRegular():
+		src, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(f, src)
+		return err
+	}
+
+	return nil
+}
+
+func extractZip(archivePath string, targetDir string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var dirs []*zip.File
+	var symlinks []extractedSymlink
+
+	for _, f := range r.File {
+		if f.Mode()&os.ModeSymlink != 0 {
+			s, err := readZipSymlink(f, targetDir)
+			if err != nil {
+				return err
+			}
+			symlinks = append(symlinks, s)
+			continue
+		}
+
+		err = extractZipFile(f, targetDir)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			dirs = append(dirs, f)
+		}
+	}
+
+	err = extractSymlinks(targetDir, symlinks)
+	if err != nil {
+		return err
+	}
+
+	// Extracting files changes the modification time of their directory so these are restored last, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(targetDir, filepath.FromSlash(dirs[i].Name))
+		err = restoreMetadata(target, dirs[i].Mode(), dirs[i].Modified, 0, 0, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(f *zip.File, targetDir string) error {
+	target, err := extractPath(targetDir, f.Name)
+	if err != nil {
+		return err
+	}
+
+	if f.FileInfo().IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	mode := f.Mode()
+
+	err = writeExtractedFile(target, rc)
+	if err != nil {
+		return err
+	}
+
+	// Archives created by older versions of frosty did not record any permissions or modification times.
+	if mode.Perm() == 0 {
+		return os.Chmod(target, 0644)
+	}
+
+	return restoreMetadata(target, mode, f.Modified, 0, 0, false)
+}
+
+// Read a symlink entry from a zip archive, whose contents are the path it links to.
+func readZipSymlink(f *zip.File, targetDir string) (extractedSymlink, error) {
+	target, err := extractPath(targetDir, f.Name)
+	if err != nil {
+		return extractedSymlink{}, err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return extractedSymlink{}, err
+	}
+	defer rc.Close()
+
+	link, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return extractedSymlink{}, err
+	}
+
+	return extractedSymlink{
+		Name:     f.Name,
+		Target:   target,
+		Linkname: string(link),
+	}, nil
+}
+
+// Stream the contents of an archive entry into a new file at target. A symlink already at target is replaced rather
+// than written through.
+func writeExtractedFile(target string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(target)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		err = os.Remove(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, r)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
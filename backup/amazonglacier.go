@@ -1,30 +1,76 @@
 package backupservice
 
 import (
-	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-
-	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"log"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mleonard87/frosty/archivekey"
 	"github.com/mleonard87/frosty/config"
 )
 
-const ()
+const (
+	GLACIER_JOB_TYPE_ARCHIVE_RETRIEVAL   = "archive-retrieval"
+	GLACIER_JOB_TYPE_INVENTORY_RETRIEVAL = "inventory-retrieval"
+	GLACIER_JOB_STATUS_SUCCEEDED         = "Succeeded"
+	GLACIER_INVENTORY_FORMAT             = "JSON"
+	// Glacier jobs typically take 3-5 hours to complete so there is no point in checking on them very often.
+	GLACIER_JOB_POLL_INTERVAL = 15 * time.Minute
+	// Returned when a vault does not exist.
+	ERROR_CODE_RESOURCE_NOT_FOUND = "ResourceNotFoundException"
+)
+
+// The JSON vault inventory returned by an inventory-retrieval job.
+type glacierInventory struct {
+	InventoryDate time.Time
+	ArchiveList   []GlacierInventoryArchive
+}
+
+// An archive listed in the inventory of a Glacier vault.
+type GlacierInventoryArchive struct {
+	ArchiveId          string
+	ArchiveDescription string
+	CreationDate       time.Time
+	Size               int64
+	SHA256TreeHash     string
+}
+
+// The archives listed from the inventory of a vault, or the error retrieving it.
+type vaultArchives struct {
+	Vault    string
+	Archives []Archive
+	Error    error
+}
 
 type AmazonGlacierBackupService struct {
-	AccessKeyId     string
-	SecretAccessKey string
-	Region          string
-	AccountId       string
-	VaultName       string
-	GlacierService  *glacier.Glacier
+	Credentials AWSCredentials
+	// "-" for the account that the credentials belong to.
+	AccountId     string
+	VaultName     string
+	RetentionDays int64
+	// Whether archives may be deleted before Glacier's minimum storage duration, incurring an early deletion charge.
+	AllowEarlyDeletion bool
+	// Files larger than a part are uploaded in parts of this many bytes, this many parts at a time.
+	PartSize          int64
+	UploadConcurrency int
+	// The template for the descriptions of archives.
+	KeyTemplate    *archivekey.Template
+	GlacierService *glacier.Glacier
+	// Multipart uploads that failed part way through and are carried on by the next attempt.
+	pendingUploads pendingUploads
 }
 
 // Return the backup service type this must match the string as used as the JSON property in the frosty backup config.
@@ -34,20 +80,78 @@ func (agss *AmazonGlacierBackupService) Name() string {
 
 // Initialise any variable needed for backups.
 func (agss *AmazonGlacierBackupService) SetConfig(backupConfig *config.BackupConfig) {
-	agss.AccessKeyId = backupConfig.BackupConfig["accessKeyId"].(string)
-	agss.SecretAccessKey = backupConfig.BackupConfig["secretAccessKey"].(string)
-	agss.Region = backupConfig.BackupConfig["region"].(string)
-	agss.AccountId = backupConfig.BackupConfig["accountId"].(string)
+	agss.Credentials = getAWSCredentials(backupConfig)
+
+	// accountId is optional.
+	agss.AccountId, _ = backupConfig.BackupConfig["accountId"].(string)
+	if agss.AccountId == "" {
+		agss.AccountId = "-"
+	}
+
+	// vaultName is optional.
+	vn, ok := backupConfig.BackupConfig["vaultName"]
+	if ok {
+		agss.VaultName = vn.(string)
+	} else {
+		agss.VaultName = ""
+	}
 	agss.VaultName = agss.getVaultName()
+
+	// Attempt to get the retentionDays config property. If this can't be found then default to 0.
+	// 0 will keep archives indefinitely.
+	rd, ok := backupConfig.BackupConfig["retentionDays"]
+	if ok {
+		agss.RetentionDays = int64(rd.(float64))
+	} else {
+		agss.RetentionDays = 0
+	}
+
+	// allowEarlyDeletion is optional.
+	aed, ok := backupConfig.BackupConfig["allowEarlyDeletion"]
+	if ok {
+		agss.AllowEarlyDeletion = aed.(bool)
+	} else {
+		agss.AllowEarlyDeletion = false
+	}
+
+	// partSizeMB and uploadConcurrency are optional.
+	agss.PartSize, agss.UploadConcurrency = getUploadOptions(backupConfig)
+
+	// keyTemplate and keyPrefix are optional.
+	agss.KeyTemplate = getKeyTemplate(backupConfig)
+}
+
+// Check that the vault can be reached with the configured credentials. A vault that does not exist yet passes as it is
+// created when backups are first run.
+func (agss *AmazonGlacierBackupService) Check() (string, error) {
+	_, err := agss.getGlacierService()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = agss.GlacierService.DescribeVault(&glacier.DescribeVaultInput{
+		AccountId: aws.String(agss.AccountId),
+		VaultName: aws.String(agss.VaultName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ERROR_CODE_RESOURCE_NOT_FOUND {
+			return fmt.Sprintf("vault %s does not exist yet and will be created when backups are first run", agss.VaultName), nil
+		}
+		return "", err
+	}
+
+	return fmt.Sprintf("vault %s is accessible", agss.VaultName), nil
 }
 
 // Initialise anything in the backup service that needs to be created prior to uploading files. In this instance we need
 // to create a vault for the backup to hold any archives.
-func (agss *AmazonGlacierBackupService) Init() error {
-	agss.setEnvvars()
-	agss.GlacierService = glacier.New(session.New(), &aws.Config{})
+func (agss *AmazonGlacierBackupService) Init(jobs []config.JobConfig) error {
+	_, err := agss.getGlacierService()
+	if err != nil {
+		return err
+	}
 
-	err := agss.createVault(agss.VaultName)
+	err = agss.createVault(agss.VaultName)
 	if err != nil {
 		return err
 	}
@@ -55,44 +159,477 @@ func (agss *AmazonGlacierBackupService) Init() error {
 	return nil
 }
 
-// Store the file in pathToFile in Amazon Glacier.
-func (agss *AmazonGlacierBackupService) StoreFile(pathToFile string) error {
-	fileContents, err := ioutil.ReadFile(pathToFile)
+// Store the file in pathToFile in Amazon Glacier. The archive is described with the key template in the same way as S3
+// object keys so that it can be identified in the vault inventory, and its SHA-256 tree hash is sent with it so that
+// Glacier rejects the upload if the archive was corrupted on the way. Files larger than the part size are sent as a
+// multipart upload, which carries on from a previous attempt at storing the file that failed part way through.
+func (agss *AmazonGlacierBackupService) StoreFile(ctx context.Context, pathToFile string, jobConfig config.JobConfig, metadata ArchiveMetadata) (Archive, error) {
+	_, err := agss.getGlacierService()
+	if err != nil {
+		return Archive{}, err
+	}
+
+	f, err := os.Open(pathToFile)
+	if err != nil {
+		return Archive{}, err
+	}
+	defer f.Close()
+
+	size, err := getFileSize(pathToFile)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	_, fileName := filepath.Split(pathToFile)
+	a, err := newArchive(agss.KeyTemplate, jobConfig.Name, fileName, metadata.RunId)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	var resp *glacier.ArchiveCreationOutput
+	var treeHash string
+	if size > agss.PartSize {
+		upload, ok := agss.pendingUploads.take(pathToFile)
+		if ok {
+			a = upload.Archive
+		} else {
+			upload = pendingUpload{
+				Archive:  a,
+				Size:     size,
+				PartSize: fitPartSize(size, agss.PartSize),
+			}
+		}
+		resp, treeHash, err = agss.uploadArchiveMultipart(ctx, f, pathToFile, upload)
+	} else {
+		resp, treeHash, err = agss.uploadArchive(f, a.Key)
+	}
+	if err != nil {
+		return Archive{}, err
+	}
+
+	if checksum := aws.StringValue(resp.Checksum); checksum != "" && checksum != treeHash {
+		return Archive{}, fmt.Errorf("Glacier archive %s has a tree hash of %s but %s was uploaded", aws.StringValue(resp.ArchiveId), checksum, treeHash)
+	}
+
+	// The archive was described by its key, which Glacier replaces with an ID of its own.
+	a.Size = size
+	a.Container = agss.VaultName
+	a.Description = a.Key
+	a.Key = aws.StringValue(resp.ArchiveId)
+	a.Checksum = treeHash
+
+	return a, nil
+}
+
+// Get a friendly name for the email template of where this backup was stored. In this case, the name of the Glacier
+// vault.
+func (agss *AmazonGlacierBackupService) BackupLocation() string {
+	return fmt.Sprintf("Glacier Vault: %s", agss.getVaultName())
+}
+
+// List the archives stored for the given job on the given host, or for every job if no job name is given. Archives can
+// only be listed by retrieving the inventory of each of the host's vaults so this will take several hours to complete.
+func (agss *AmazonGlacierBackupService) ListArchives(ctx context.Context, hostname string, jobName string) ([]Archive, error) {
+	_, err := agss.getGlacierService()
+	if err != nil {
+		return nil, err
+	}
+
+	vaultNames, err := agss.listVaultNames(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan vaultArchives)
+	var wg sync.WaitGroup
+
+	// Inventory retrieval jobs for each vault are run at the same time rather than waiting hours for each in turn.
+	for _, vn := range vaultNames {
+		wg.Add(1)
+		go func(vaultName string) {
+			defer wg.Done()
+
+			archives, err := agss.listVaultArchives(ctx, vaultName, jobName)
+			ch <- vaultArchives{
+				Vault:    vaultName,
+				Archives: archives,
+				Error:    err,
+			}
+		}(vn)
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	var archives []Archive
+	var vaultErr error
+
+	// Every vault is waited for so that no retrieval is left sending on the channel.
+	for va := range ch {
+		if va.Error != nil {
+			log.Printf("Unable to retrieve the inventory of Glacier vault %s: %s\n", va.Vault, va.Error)
+			if vaultErr == nil {
+				vaultErr = fmt.Errorf("Unable to retrieve the inventory of Glacier vault %s: %s", va.Vault, va.Error)
+			}
+			continue
+		}
+		archives = append(archives, va.Archives...)
+	}
+
+	if vaultErr != nil {
+		return nil, vaultErr
+	}
+
+	return archives, nil
+}
+
+// Get the number of days archives are kept for unless a job overrides it.
+func (agss *AmazonGlacierBackupService) GetRetentionDays() int64 {
+	return agss.RetentionDays
+}
+
+// Delete the archive from its Glacier vault.
+func (agss *AmazonGlacierBackupService) DeleteArchive(archive Archive) error {
+	svc, err := agss.getGlacierService()
 	if err != nil {
 		return err
 	}
 
-	params := &glacier.UploadArchiveInput{
+	params := &glacier.DeleteArchiveInput{
 		AccountId: aws.String(agss.AccountId),
-		VaultName: aws.String(agss.VaultName),
-		Body:      bytes.NewReader(fileContents),
+		VaultName: aws.String(archive.Container),
+		ArchiveId: aws.String(archive.Key),
 	}
 
-	_, err = agss.GlacierService.UploadArchive(params)
+	_, err = svc.DeleteArchive(params)
 	if err != nil {
+		log.Printf("Failed to delete archive %s from Glacier vault %s\n", archive.Key, archive.Container)
+		log.Println(err)
 		return err
 	}
 
 	return nil
 }
 
-// Get the name to be used for the .zip archive without the .zip extension.
-func (agss *AmazonGlacierBackupService) ArtifactFilename(jobName string) string {
-	return jobName
+// Retrieve the inventory of the vault, returning when it was taken and every archive in it. Glacier only updates a
+// vault's inventory about once a day so archives stored since then will not be included. This will take several
+// hours to complete.
+func (agss *AmazonGlacierBackupService) RetrieveInventory(ctx context.Context, vaultName string) (time.Time, []GlacierInventoryArchive, error) {
+	_, err := agss.getGlacierService()
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	inventory, err := agss.getVaultInventory(ctx, vaultName)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	return inventory.InventoryDate, inventory.ArchiveList, nil
 }
 
-// Get a friendly name for the email template of where this backup was stored. In this case, the name of the Glacier
-// vault.
-func (agss *AmazonGlacierBackupService) BackupLocation() string {
-	return fmt.Sprintf("Glacier Vault: %s", agss.getVaultName())
+// Retrieve the archive from its Glacier vault into pathToFile. The archive must first be staged by Glacier so this
+// will take several hours to complete.
+func (agss *AmazonGlacierBackupService) RetrieveFile(ctx context.Context, archive Archive, pathToFile string) error {
+	_, err := agss.getGlacierService()
+	if err != nil {
+		return err
+	}
+
+	jobParameters := &glacier.JobParameters{
+		Type:      aws.String(GLACIER_JOB_TYPE_ARCHIVE_RETRIEVAL),
+		ArchiveId: aws.String(archive.Key),
+	}
+
+	jobId, err := agss.runJob(ctx, archive.Container, jobParameters)
+	if err != nil {
+		return err
+	}
+
+	output, err := agss.getJobOutput(archive.Container, jobId)
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+
+	return writeFile(pathToFile, output.Body)
+}
+
+// Upload the file as an archive in a single request, returning the archive along with the tree hash that was sent.
+func (agss *AmazonGlacierBackupService) uploadArchive(f *os.File, description string) (*glacier.ArchiveCreationOutput, string, error) {
+	treeHash := hex.EncodeToString(glacier.ComputeHashes(f).TreeHash)
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", err
+	}
+
+	params := &glacier.UploadArchiveInput{
+		AccountId:          aws.String(agss.AccountId),
+		VaultName:          aws.String(agss.VaultName),
+		ArchiveDescription: aws.String(description),
+		Checksum:           aws.String(treeHash),
+		Body:               f,
+	}
+
+	resp, err := agss.GlacierService.UploadArchive(params)
+	return resp, treeHash, err
+}
+
+// Upload the file as an archive in parts, starting the upload unless it is being carried on from a previous attempt,
+// and return the archive along with the tree hash that was sent. Each part is sent with its own tree hash. If any part
+// can't be sent the upload is kept so that the next attempt only sends the parts that weren't, and it is aborted by
+// AbortUpload if there is no next attempt.
+func (agss *AmazonGlacierBackupService) uploadArchiveMultipart(ctx context.Context, f *os.File, pathToFile string, upload pendingUpload) (*glacier.ArchiveCreationOutput, string, error) {
+	parts := splitParts(upload.Size, upload.PartSize)
+
+	if upload.UploadId == "" {
+		initiateParams := &glacier.InitiateMultipartUploadInput{
+			AccountId:          aws.String(agss.AccountId),
+			VaultName:          aws.String(agss.VaultName),
+			ArchiveDescription: aws.String(upload.Archive.Key),
+			PartSize:           aws.String(strconv.FormatInt(upload.PartSize, 10)),
+		}
+
+		resp, err := agss.GlacierService.InitiateMultipartUpload(initiateParams)
+		if err != nil {
+			return nil, "", err
+		}
+		upload.UploadId = aws.StringValue(resp.UploadId)
+		upload.Sent = make([]string, len(parts))
+	} else {
+		log.Printf("Carrying on the upload of %s to Glacier vault %s, %d of %d parts were sent by the previous attempt\n", pathToFile, agss.VaultName, upload.sentCount(), len(parts))
+	}
+
+	err := uploadParts(ctx, f, upload.unsentParts(parts), agss.UploadConcurrency, func(part uploadPart, body io.ReadSeeker) error {
+		partTreeHash := glacier.ComputeHashes(body).TreeHash
+		_, err := body.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		params := &glacier.UploadMultipartPartInput{
+			AccountId: aws.String(agss.AccountId),
+			VaultName: aws.String(agss.VaultName),
+			UploadId:  aws.String(upload.UploadId),
+			Range:     aws.String(fmt.Sprintf("bytes %d-%d/*", part.Offset, part.Offset+part.Size-1)),
+			Checksum:  aws.String(hex.EncodeToString(partTreeHash)),
+			Body:      body,
+		}
+
+		_, err = agss.GlacierService.UploadMultipartPart(params)
+		if err != nil {
+			return err
+		}
+
+		// Each part is only written by the goroutine that sent it.
+		upload.Sent[part.Number-1] = hex.EncodeToString(partTreeHash)
+		return nil
+	})
+	if err != nil {
+		agss.pendingUploads.keep(pathToFile, upload)
+		return nil, "", err
+	}
+
+	partTreeHashes := make([][]byte, len(parts))
+	for i, h := range upload.Sent {
+		partTreeHashes[i], err = hex.DecodeString(h)
+		if err != nil {
+			agss.abortMultipartUpload(aws.String(upload.UploadId))
+			return nil, "", err
+		}
+	}
+
+	// As parts are a power of two MB each part's tree hash is a node of the archive's tree, so the archive's tree hash
+	// can be built from them without reading the file again.
+	treeHash := hex.EncodeToString(glacier.ComputeTreeHash(partTreeHashes))
+
+	completeParams := &glacier.CompleteMultipartUploadInput{
+		AccountId:   aws.String(agss.AccountId),
+		VaultName:   aws.String(agss.VaultName),
+		UploadId:    aws.String(upload.UploadId),
+		ArchiveSize: aws.String(strconv.FormatInt(upload.Size, 10)),
+		Checksum:    aws.String(treeHash),
+	}
+
+	resp, err := agss.GlacierService.CompleteMultipartUpload(completeParams)
+	if err != nil {
+		agss.abortMultipartUpload(aws.String(upload.UploadId))
+		return nil, "", err
+	}
+
+	return resp, treeHash, nil
+}
+
+// Abort the failed multipart upload of a file that was kept for another attempt, if there is one.
+func (agss *AmazonGlacierBackupService) AbortUpload(pathToFile string) {
+	upload, ok := agss.pendingUploads.take(pathToFile)
+	if ok {
+		agss.abortMultipartUpload(aws.String(upload.UploadId))
+	}
+}
+
+// Abort a multipart upload, discarding any parts already sent.
+func (agss *AmazonGlacierBackupService) abortMultipartUpload(uploadId *string) {
+	params := &glacier.AbortMultipartUploadInput{
+		AccountId: aws.String(agss.AccountId),
+		VaultName: aws.String(agss.VaultName),
+		UploadId:  uploadId,
+	}
+
+	_, err := agss.GlacierService.AbortMultipartUpload(params)
+	if err != nil {
+		log.Printf("Failed to abort multipart upload %s to Glacier vault %s\n", aws.StringValue(uploadId), agss.VaultName)
+		log.Println(err)
+	}
+}
+
+// Get the Glacier client, creating it if this has not already been done.
+func (agss *AmazonGlacierBackupService) getGlacierService() (*glacier.Glacier, error) {
+	if agss.GlacierService == nil {
+		sess, err := agss.Credentials.newSession()
+		if err != nil {
+			return nil, err
+		}
+		agss.GlacierService = glacier.New(sess, &aws.Config{})
+	}
+
+	return agss.GlacierService, nil
+}
+
+// Get the names of all vaults created by frosty for the given host, along with the configured vault.
+func (agss *AmazonGlacierBackupService) listVaultNames(hostname string) ([]string, error) {
+	vaultNames := []string{agss.VaultName}
+
+	params := &glacier.ListVaultsInput{
+		AccountId: aws.String(agss.AccountId),
+	}
+
+	err := agss.GlacierService.ListVaultsPages(params, func(page *glacier.ListVaultsOutput, lastPage bool) bool {
+		for _, v := range page.VaultList {
+			vn := aws.StringValue(v.VaultName)
+			if vn != agss.VaultName && strings.HasPrefix(vn, BACKUP_NAME_PREFIX) && strings.HasSuffix(vn, "_"+hostname) {
+				vaultNames = append(vaultNames, vn)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return vaultNames, nil
+}
+
+// Retrieve the inventory of a vault and return the archives in it that were stored for the given job.
+func (agss *AmazonGlacierBackupService) listVaultArchives(ctx context.Context, vaultName string, jobName string) ([]Archive, error) {
+	inventory, err := agss.getVaultInventory(ctx, vaultName)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []Archive
+
+	for _, ia := range inventory.ArchiveList {
+		// Archives stored without a frosty description can't be matched to a job so are ignored.
+		a, ok := parseObjectKey(agss.KeyTemplate, ia.ArchiveDescription)
+		if !ok || (jobName != "" && a.JobName != jobName) {
+			continue
+		}
+		a.Size = ia.Size
+		a.Container = vaultName
+		a.Key = ia.ArchiveId
+		a.Description = ia.ArchiveDescription
+		a.Checksum = ia.SHA256TreeHash
+		archives = append(archives, a)
+	}
+
+	return archives, nil
+}
+
+// Run an inventory-retrieval job against a vault and decode its output.
+func (agss *AmazonGlacierBackupService) getVaultInventory(ctx context.Context, vaultName string) (glacierInventory, error) {
+	var inventory glacierInventory
+
+	jobParameters := &glacier.JobParameters{
+		Type:   aws.String(GLACIER_JOB_TYPE_INVENTORY_RETRIEVAL),
+		Format: aws.String(GLACIER_INVENTORY_FORMAT),
+	}
+
+	jobId, err := agss.runJob(ctx, vaultName, jobParameters)
+	if err != nil {
+		return inventory, err
+	}
+
+	output, err := agss.getJobOutput(vaultName, jobId)
+	if err != nil {
+		return inventory, err
+	}
+	defer output.Body.Close()
+
+	err = json.NewDecoder(output.Body).Decode(&inventory)
+	return inventory, err
+}
+
+// Start a Glacier job against a vault and wait for it to complete, returning the ID of the job. Stops waiting and
+// returns the context's error if it is cancelled first.
+func (agss *AmazonGlacierBackupService) runJob(ctx context.Context, vaultName string, jobParameters *glacier.JobParameters) (string, error) {
+	params := &glacier.InitiateJobInput{
+		AccountId:     aws.String(agss.AccountId),
+		VaultName:     aws.String(vaultName),
+		JobParameters: jobParameters,
+	}
+
+	job, err := agss.GlacierService.InitiateJob(params)
+	if err != nil {
+		return "", err
+	}
+
+	jobId := aws.StringValue(job.JobId)
+
+	for {
+		desc, err := agss.GlacierService.DescribeJob(&glacier.DescribeJobInput{
+			AccountId: aws.String(agss.AccountId),
+			VaultName: aws.String(vaultName),
+			JobId:     aws.String(jobId),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		if aws.BoolValue(desc.Completed) {
+			if aws.StringValue(desc.StatusCode) != GLACIER_JOB_STATUS_SUCCEEDED {
+				return "", fmt.Errorf("Glacier %s job %s failed: %s", aws.StringValue(jobParameters.Type), jobId, aws.StringValue(desc.StatusMessage))
+			}
+			return jobId, nil
+		}
+
+		log.Printf("Waiting for Glacier %s job on vault %s to complete...\n", aws.StringValue(jobParameters.Type), vaultName)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(GLACIER_JOB_POLL_INTERVAL):
+		}
+	}
+}
+
+// Get the output of a completed Glacier job. The caller must close the body of the output.
+func (agss *AmazonGlacierBackupService) getJobOutput(vaultName string, jobId string) (*glacier.GetJobOutputOutput, error) {
+	params := &glacier.GetJobOutputInput{
+		AccountId: aws.String(agss.AccountId),
+		VaultName: aws.String(vaultName),
+		JobId:     aws.String(jobId),
+	}
+
+	return agss.GlacierService.GetJobOutput(params)
 }
 
 // Create the Glacier Vault.
 func (agss *AmazonGlacierBackupService) createVault(vaultName string) error {
-	agss.setEnvvars()
 	params := &glacier.CreateVaultInput{
 		AccountId: aws.String(agss.AccountId),
-		VaultName: aws.String(agss.VaultName),
+		VaultName: aws.String(vaultName),
 	}
 
 	_, err := agss.GlacierService.CreateVault(params)
@@ -103,21 +640,16 @@ func (agss *AmazonGlacierBackupService) createVault(vaultName string) error {
 	return nil
 }
 
-// Set the required AWS environment variables.
-func (agss *AmazonGlacierBackupService) setEnvvars() {
-	os.Setenv(ENVVAR_AWS_ACCESS_KEY_ID, agss.AccessKeyId)
-	os.Setenv(ENVVAR_AWS_SECRET_ACCESS_KEY, agss.SecretAccessKey)
-	os.Setenv(ENVVAR_AWS_REGION, agss.Region)
-}
-
-// Get the name to use for for the Glacier Vault.
+// Get the name to use for the Glacier Vault. Unless one is configured this is a single vault for the host. Older
+// versions of frosty created a new vault each day named frosty_YYYYMMDD_hostname which are still searched when
+// listing archives.
 func (agss *AmazonGlacierBackupService) getVaultName() string {
 	if agss.VaultName == "" {
 		hostname, err := os.Hostname()
 		if err != nil {
 			log.Fatal("Could not determine hostname.", err)
 		}
-		agss.VaultName = BACKUP_NAME_PREFIX + time.Now().Format("20060102") + "_" + hostname
+		agss.VaultName = BACKUP_NAME_PREFIX + hostname
 	}
 
 	return agss.VaultName
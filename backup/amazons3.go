@@ -1,38 +1,63 @@
 package backupservice
 
 import (
+	"context"
+	"io"
 	"log"
+	"net/url"
 	"os"
 
 	"fmt"
 
 	"path/filepath"
-
-	"time"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mleonard87/frosty/archivekey"
 	"github.com/mleonard87/frosty/config"
 )
 
 const (
 	ERROR_CODE_INVALID_BUCKET_NAME         string = "InvalidBucketName"
 	ERROR_CODE_BUCKET_ALREADY_OWNED_BY_YOU string = "BucketAlreadyOwnedByYou"
+	ERROR_CODE_NO_SUCH_LIFECYCLE_CONFIG    string = "NoSuchLifecycleConfiguration"
 	LIFECYCLE_ID                           string = "frosty-backup-retention-policy"
+	// HeadBucket has no response body so only the HTTP status is given as the code.
+	ERROR_CODE_NOT_FOUND string = "NotFound"
+	ERROR_CODE_FORBIDDEN string = "Forbidden"
+	// Tags frosty adds to every object it stores so lifecycle rules and cost reports can target them.
+	TAG_KEY_HOSTNAME string = "frosty-hostname"
+	TAG_KEY_JOB      string = "frosty-job"
 )
 
+// The settings an archive's object is created with.
+type s3ObjectOptions struct {
+	StorageClass         *string
+	ServerSideEncryption *string
+	SSEKMSKeyId          *string
+	Metadata             map[string]*string
+	Tagging              *string
+}
+
 type AmazonS3BackupService struct {
-	AccessKeyId        string
-	SecretAccessKey    string
-	Region             string
+	Credentials        AWSCredentials
 	AccountId          string
 	RetentionDays      int64
 	BucketName         string
 	Endpoint           string
 	UsePathStyleAccess bool
-	S3Service          *s3.S3
+	// Files larger than a part are uploaded in parts of this many bytes, this many parts at a time.
+	PartSize          int64
+	UploadConcurrency int
+	// The template for the keys of archive objects.
+	KeyTemplate *archivekey.Template
+	// The global settings for archive objects, which each job's own settings are applied over.
+	ObjectConfig config.S3ObjectConfig
+	S3Service    *s3.S3
+	// Multipart uploads that failed part way through and are carried on by the next attempt.
+	pendingUploads pendingUploads
 }
 
 // Return the backup service type this must match the string as used as the JSON property in the frosty backup config.
@@ -42,10 +67,10 @@ func (agss *AmazonS3BackupService) Name() string {
 
 // Initialise any variable needed for backups.
 func (asbs *AmazonS3BackupService) SetConfig(backupConfig *config.BackupConfig) {
-	asbs.AccessKeyId = backupConfig.BackupConfig["accessKeyId"].(string)
-	asbs.SecretAccessKey = backupConfig.BackupConfig["secretAccessKey"].(string)
-	asbs.Region = backupConfig.BackupConfig["region"].(string)
-	asbs.AccountId = backupConfig.BackupConfig["accountId"].(string)
+	asbs.Credentials = getAWSCredentials(backupConfig)
+
+	// accountId is optional.
+	asbs.AccountId, _ = backupConfig.BackupConfig["accountId"].(string)
 
 	// Attempt to get the retentionDays config property. If this can't be found then default to 0.
 	// 0 will not set a life cycle policy and any existing policy will remain.
@@ -73,32 +98,57 @@ func (asbs *AmazonS3BackupService) SetConfig(backupConfig *config.BackupConfig)
 	} else {
 		asbs.UsePathStyleAccess = false
 	}
+
+	// partSizeMB and uploadConcurrency are optional.
+	asbs.PartSize, asbs.UploadConcurrency = getUploadOptions(backupConfig)
+
+	// keyTemplate and keyPrefix are optional.
+	asbs.KeyTemplate = getKeyTemplate(backupConfig)
+}
+
+// Check that the bucket can be reached with the configured credentials. A bucket that does not exist yet passes as it
+// is created when backups are first run.
+func (asbs *AmazonS3BackupService) Check() (string, error) {
+	_, err := asbs.getS3Service()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = asbs.S3Service.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(asbs.BucketName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case ERROR_CODE_NOT_FOUND:
+				return fmt.Sprintf("bucket %s does not exist yet and will be created when backups are first run", asbs.BucketName), nil
+			case ERROR_CODE_FORBIDDEN:
+				return "", fmt.Errorf("access to bucket %s was denied, check the credentials and the bucket's policy", asbs.BucketName)
+			}
+		}
+		return "", err
+	}
+
+	return fmt.Sprintf("bucket %s is accessible", asbs.BucketName), nil
 }
 
 // Initialise anything in the backup service that needs to be created prior to uploading files. In this instance we need
 // to create a bucket to store the backups if one does not already exist. This always uses a bucket
 // called "frosty.backups".
-func (asbs *AmazonS3BackupService) Init() error {
-	asbs.setEnvvars()
-
-	ac := &aws.Config{}
-	ac.S3ForcePathStyle = &asbs.UsePathStyleAccess
-	if asbs.Endpoint != "" {
-		ac.Endpoint = &asbs.Endpoint
-	} else {
-		ac = &aws.Config{}
+func (asbs *AmazonS3BackupService) Init(jobs []config.JobConfig) error {
+	_, err := asbs.getS3Service()
+	if err != nil {
+		return err
 	}
 
-	asbs.S3Service = s3.New(session.New(), ac)
-
-	err := asbs.createBucket(asbs.BucketName)
+	err = asbs.createBucket(asbs.BucketName)
 	if err != nil {
 		log.Println("Error creating bucket")
 		log.Println(err)
 		return err
 	}
 
-	err = asbs.putBucketLifecycleConfiguration()
+	err = asbs.putBucketLifecycleConfiguration(jobs)
 	if err != nil {
 		log.Println("Error creating bucket lifecycle")
 		log.Println(err)
@@ -108,28 +158,128 @@ func (asbs *AmazonS3BackupService) Init() error {
 	return nil
 }
 
-// Store the file in pathToFile in the bucket in S3.
-func (asbs *AmazonS3BackupService) StoreFile(pathToFile string) error {
+// Store the file in pathToFile in the bucket in S3. Files larger than the part size are sent as a multipart upload,
+// which carries on from a previous attempt at storing the file that failed part way through.
+func (asbs *AmazonS3BackupService) StoreFile(ctx context.Context, pathToFile string, jobConfig config.JobConfig, metadata ArchiveMetadata) (Archive, error) {
 	_, fileName := filepath.Split(pathToFile)
 
-	key := getObjectKey(fileName)
+	_, err := asbs.getS3Service()
+	if err != nil {
+		return Archive{}, err
+	}
+
+	a, err := newArchive(asbs.KeyTemplate, jobConfig.Name, fileName, metadata.RunId)
+	if err != nil {
+		return Archive{}, err
+	}
 
 	f, err := os.Open(pathToFile)
 	if err != nil {
 		log.Printf("Failed to open file to store: %s", pathToFile)
 		log.Println(err)
+		return Archive{}, err
+	}
+	defer f.Close()
+
+	size, err := getFileSize(pathToFile)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	options, err := getObjectOptions(jobConfig, asbs.ObjectConfig, metadata)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	if size > asbs.PartSize {
+		upload, ok := asbs.pendingUploads.take(pathToFile)
+		if ok {
+			a = upload.Archive
+		} else {
+			upload = pendingUpload{
+				Archive:  a,
+				Size:     size,
+				PartSize: fitPartSize(size, asbs.PartSize),
+			}
+		}
+		err = asbs.putObjectMultipart(ctx, f, pathToFile, upload, options)
+	} else {
+		err = asbs.putObject(f, a.Key, options)
+	}
+	if err != nil {
+		log.Printf("Failed to put object %s into bucket %s with a key of %s\n", pathToFile, asbs.BucketName, a.Key)
+		log.Println(err)
+		return Archive{}, err
+	}
+
+	a.Container = asbs.BucketName
+	a.Size = size
+
+	return a, nil
+}
+
+// Get a friendly name for the email template of where this backup was stored. In this case, the name of the S3 bucket.
+func (asbs *AmazonS3BackupService) BackupLocation() string {
+	return fmt.Sprintf("S3 Bucket: %s", asbs.BucketName)
+}
+
+// List the archives stored in the bucket for the given job on the given host.
+func (asbs *AmazonS3BackupService) ListArchives(ctx context.Context, hostname string, jobName string) ([]Archive, error) {
+	svc, err := asbs.getS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []Archive
+
+	for _, prefix := range getListPrefixes(asbs.KeyTemplate, hostname) {
+		params := &s3.ListObjectsInput{
+			Bucket: aws.String(asbs.BucketName),
+			Prefix: aws.String(prefix),
+		}
+
+		err = svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			for _, o := range page.Contents {
+				a, ok := parseObjectKey(asbs.KeyTemplate, aws.StringValue(o.Key))
+				if !ok || a.Hostname != hostname || a.JobName != jobName {
+					continue
+				}
+				a.Size = aws.Int64Value(o.Size)
+				a.Container = asbs.BucketName
+				archives = append(archives, a)
+			}
+			return true
+		})
+		if err != nil {
+			log.Printf("Failed to list objects in bucket %s\n", asbs.BucketName)
+			log.Println(err)
+			return nil, err
+		}
+	}
+
+	return archives, nil
+}
+
+// Get the number of days archives are kept for unless a job overrides it.
+func (asbs *AmazonS3BackupService) GetRetentionDays() int64 {
+	return asbs.RetentionDays
+}
+
+// Delete the archive's object from its bucket in S3.
+func (asbs *AmazonS3BackupService) DeleteArchive(archive Archive) error {
+	svc, err := asbs.getS3Service()
+	if err != nil {
 		return err
 	}
 
-	params := &s3.PutObjectInput{
-		Body:   f,
-		Bucket: &asbs.BucketName,
-		Key:    &key,
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(archive.Container),
+		Key:    aws.String(archive.Key),
 	}
 
-	_, err = asbs.S3Service.PutObject(params)
+	_, err = svc.DeleteObject(params)
 	if err != nil {
-		log.Printf("Failed to put object %s into bucket %s with a key of %s\n", pathToFile, asbs.BucketName, fileName)
+		log.Printf("Failed to delete object %s from bucket %s\n", archive.Key, archive.Container)
 		log.Println(err)
 		return err
 	}
@@ -137,19 +287,171 @@ func (asbs *AmazonS3BackupService) StoreFile(pathToFile string) error {
 	return nil
 }
 
-// Get the name to be used for the .zip archive without the .zip extension.
-func (asbs *AmazonS3BackupService) ArtifactFilename(jobName string) string {
-	return jobName
+// Download the archive from its bucket in S3 into pathToFile.
+func (asbs *AmazonS3BackupService) RetrieveFile(ctx context.Context, archive Archive, pathToFile string) error {
+	svc, err := asbs.getS3Service()
+	if err != nil {
+		return err
+	}
+
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(archive.Container),
+		Key:    aws.String(archive.Key),
+	}
+
+	resp, err := svc.GetObject(params)
+	if err != nil {
+		log.Printf("Failed to get object %s from bucket %s\n", archive.Key, archive.Container)
+		log.Println(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	return writeFile(pathToFile, resp.Body)
 }
 
-// Get a friendly name for the email template of where this backup was stored. In this case, the name of the S3 bucket.
-func (asbs *AmazonS3BackupService) BackupLocation() string {
-	return fmt.Sprintf("S3 Bucket: %s", asbs.BucketName)
+// Get the S3 client, creating it if this has not already been done.
+func (asbs *AmazonS3BackupService) getS3Service() (*s3.S3, error) {
+	if asbs.S3Service == nil {
+		sess, err := asbs.Credentials.newSession()
+		if err != nil {
+			return nil, err
+		}
+
+		ac := &aws.Config{}
+		ac.S3ForcePathStyle = &asbs.UsePathStyleAccess
+		if asbs.Endpoint != "" {
+			ac.Endpoint = &asbs.Endpoint
+		} else {
+			ac = &aws.Config{}
+		}
+
+		asbs.S3Service = s3.New(sess, ac)
+	}
+
+	return asbs.S3Service, nil
+}
+
+// Upload the file as an object in a single request.
+func (asbs *AmazonS3BackupService) putObject(f *os.File, key string, options s3ObjectOptions) error {
+	params := &s3.PutObjectInput{
+		Body:                 f,
+		Bucket:               aws.String(asbs.BucketName),
+		Key:                  aws.String(key),
+		StorageClass:         options.StorageClass,
+		ServerSideEncryption: options.ServerSideEncryption,
+		SSEKMSKeyId:          options.SSEKMSKeyId,
+		Metadata:             options.Metadata,
+		Tagging:              options.Tagging,
+	}
+
+	_, err := asbs.S3Service.PutObject(params)
+	return err
+}
+
+// Upload the file as an object in parts, starting the upload unless it is being carried on from a previous attempt.
+// If any part can't be sent the upload is kept so that the next attempt only sends the parts that weren't, and it is
+// aborted by AbortUpload if there is no next attempt so that S3 does not keep (and charge for) the parts that were.
+func (asbs *AmazonS3BackupService) putObjectMultipart(ctx context.Context, f *os.File, pathToFile string, upload pendingUpload, options s3ObjectOptions) error {
+	key := upload.Archive.Key
+	parts := splitParts(upload.Size, upload.PartSize)
+
+	if upload.UploadId == "" {
+		createParams := &s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(asbs.BucketName),
+			Key:                  aws.String(key),
+			StorageClass:         options.StorageClass,
+			ServerSideEncryption: options.ServerSideEncryption,
+			SSEKMSKeyId:          options.SSEKMSKeyId,
+			Metadata:             options.Metadata,
+			Tagging:              options.Tagging,
+		}
+
+		resp, err := asbs.S3Service.CreateMultipartUpload(createParams)
+		if err != nil {
+			return err
+		}
+		upload.UploadId = aws.StringValue(resp.UploadId)
+		upload.Sent = make([]string, len(parts))
+	} else {
+		log.Printf("Carrying on the upload of %s to bucket %s, %d of %d parts were sent by the previous attempt\n", pathToFile, asbs.BucketName, upload.sentCount(), len(parts))
+	}
+
+	err := uploadParts(ctx, f, upload.unsentParts(parts), asbs.UploadConcurrency, func(part uploadPart, body io.ReadSeeker) error {
+		params := &s3.UploadPartInput{
+			Body:          body,
+			Bucket:        aws.String(asbs.BucketName),
+			Key:           aws.String(key),
+			UploadId:      aws.String(upload.UploadId),
+			PartNumber:    aws.Int64(int64(part.Number)),
+			ContentLength: aws.Int64(part.Size),
+		}
+
+		resp, err := asbs.S3Service.UploadPart(params)
+		if err != nil {
+			return err
+		}
+
+		// Each part is only written by the goroutine that sent it.
+		upload.Sent[part.Number-1] = aws.StringValue(resp.ETag)
+		return nil
+	})
+	if err != nil {
+		asbs.pendingUploads.keep(pathToFile, upload)
+		return err
+	}
+
+	completedParts := make([]*s3.CompletedPart, len(parts))
+	for i, etag := range upload.Sent {
+		completedParts[i] = &s3.CompletedPart{
+			ETag:       aws.String(etag),
+			PartNumber: aws.Int64(int64(i + 1)),
+		}
+	}
+
+	completeParams := &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(asbs.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(upload.UploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	}
+
+	_, err = asbs.S3Service.CompleteMultipartUpload(completeParams)
+	if err != nil {
+		asbs.abortMultipartUpload(key, aws.String(upload.UploadId))
+		return err
+	}
+
+	return nil
+}
+
+// Abort the failed multipart upload of a file that was kept for another attempt, if there is one.
+func (asbs *AmazonS3BackupService) AbortUpload(pathToFile string) {
+	upload, ok := asbs.pendingUploads.take(pathToFile)
+	if ok {
+		asbs.abortMultipartUpload(upload.Archive.Key, aws.String(upload.UploadId))
+	}
+}
+
+// Abort a multipart upload, discarding any parts already sent.
+func (asbs *AmazonS3BackupService) abortMultipartUpload(key string, uploadId *string) {
+	params := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(asbs.BucketName),
+		Key:      aws.String(key),
+		UploadId: uploadId,
+	}
+
+	_, err := asbs.S3Service.AbortMultipartUpload(params)
+	if err != nil {
+		log.Printf("Failed to abort multipart upload of %s to bucket %s\n", key, asbs.BucketName)
+		log.Println(err)
+	}
 }
 
 // Create the S3 bucket.
 func (asbs *AmazonS3BackupService) createBucket(bucketName string) error {
-	asbs.setEnvvars()
 	params := &s3.CreateBucketInput{
 		Bucket: aws.String(bucketName),
 	}
@@ -179,49 +481,192 @@ func (asbs *AmazonS3BackupService) createBucket(bucketName string) error {
 	return nil
 }
 
-func (asbs *AmazonS3BackupService) putBucketLifecycleConfiguration() error {
-	// If the retention period is not 0 days then submit a new life cycle policy.
-	if asbs.RetentionDays != 0 {
-		params := &s3.PutBucketLifecycleConfigurationInput{
-			Bucket: aws.String(asbs.BucketName),
-			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
-				Rules: []*s3.LifecycleRule{
-					{
-						Prefix: aws.String(""),
-						Status: aws.String("Enabled"),
-						ID:     aws.String(LIFECYCLE_ID),
-						Expiration: &s3.LifecycleExpiration{
-							Days: &asbs.RetentionDays,
-						},
+// Add a lifecycle rule for each of the given jobs so that its archives on this host expire after the job's retention
+// period. Each rule is scoped to the job's key prefix so jobs can be retained for different periods. Rules belonging
+// to other jobs and hosts are left in place.
+func (asbs *AmazonS3BackupService) putBucketLifecycleConfiguration(jobs []config.JobConfig) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	replacedRuleIds := make(map[string]bool)
+	var rules []*s3.LifecycleRule
+
+	for _, j := range jobs {
+		// If the retention period is 0 days then no rule is submitted and any existing rule will remain.
+		retentionDays := j.GetRetentionDays(asbs.RetentionDays)
+		if retentionDays == 0 {
+			continue
+		}
+
+		id := getLifecycleRuleId(hostname, j.Name)
+		replacedRuleIds[id] = true
+		rule := &s3.LifecycleRule{
+			Status: aws.String("Enabled"),
+			ID:     aws.String(id),
+			Expiration: &s3.LifecycleExpiration{
+				Days: aws.Int64(retentionDays),
+			},
+		}
+
+		// If the key template doesn't start with the job name then the job's objects can't be told apart by their
+		// keys so the rule is scoped by the tags frosty adds to them instead. Every rule uses a filter as S3 rejects
+		// configurations that mix filters with the older top-level prefix.
+		prefix, includesJobName := asbs.KeyTemplate.JobPrefix(hostname, j.Name)
+		if includesJobName {
+			rule.Filter = &s3.LifecycleRuleFilter{
+				Prefix: aws.String(prefix),
+			}
+		} else {
+			rule.Filter = &s3.LifecycleRuleFilter{
+				And: &s3.LifecycleRuleAndOperator{
+					Prefix: aws.String(prefix),
+					Tags: []*s3.Tag{
+						{Key: aws.String(TAG_KEY_HOSTNAME), Value: aws.String(hostname)},
+						{Key: aws.String(TAG_KEY_JOB), Value: aws.String(j.Name)},
 					},
 				},
-			},
+			}
 		}
 
-		_, err := asbs.S3Service.PutBucketLifecycleConfiguration(params)
-		if err != nil {
-			log.Printf("Failed to create bucket lifecycle configuration, %s.\n", err)
-			return err
+		rules = append(rules, rule)
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	// Older versions of frosty used a single bucket wide rule. This would expire every job's archives regardless of
+	// the rules above so it is removed.
+	replacedRuleIds[LIFECYCLE_ID] = true
+
+	existingRules, err := asbs.getBucketLifecycleRules()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range existingRules {
+		if !replacedRuleIds[aws.StringValue(r.ID)] {
+			rules = append(rules, withFilter(r))
 		}
 	}
 
+	params := &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(asbs.BucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: rules,
+		},
+	}
+
+	_, err = asbs.S3Service.PutBucketLifecycleConfiguration(params)
+	if err != nil {
+		log.Printf("Failed to create bucket lifecycle configuration, %s.\n", err)
+		return err
+	}
+
 	return nil
 }
 
-// Set the required AWS environment variables.
-func (asbs *AmazonS3BackupService) setEnvvars() {
-	os.Setenv(ENVVAR_AWS_ACCESS_KEY_ID, asbs.AccessKeyId)
-	os.Setenv(ENVVAR_AWS_SECRET_ACCESS_KEY, asbs.SecretAccessKey)
-	os.Setenv(ENVVAR_AWS_REGION, asbs.Region)
+// Get a rule that uses the older top-level prefix as the equivalent rule with a prefix filter, so that it can be put
+// alongside rules that use filters. Rules that already use a filter are returned as they are.
+func withFilter(rule *s3.LifecycleRule) *s3.LifecycleRule {
+	if rule.Filter != nil {
+		return rule
+	}
+
+	r := *rule
+	r.Filter = &s3.LifecycleRuleFilter{
+		Prefix: aws.String(aws.StringValue(rule.Prefix)),
+	}
+	r.Prefix = nil
+
+	return &r
 }
 
-// Get the name to use for the file being stored in S3.
-func getObjectKey(fileName string) string {
+// Get the rules in the bucket's current lifecycle configuration, if it has one.
+func (asbs *AmazonS3BackupService) getBucketLifecycleRules() ([]*s3.LifecycleRule, error) {
+	params := &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(asbs.BucketName),
+	}
+
+	resp, err := asbs.S3Service.GetBucketLifecycleConfiguration(params)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ERROR_CODE_NO_SUCH_LIFECYCLE_CONFIG {
+			return nil, nil
+		}
+		log.Printf("Failed to get bucket lifecycle configuration, %s.\n", err)
+		return nil, err
+	}
+
+	return resp.Rules, nil
+}
+
+// Get the prefixes to list a host's archives under. Archives stored in the default layout before the key template
+// was changed are under a different prefix to those stored since, in which case both are listed.
+func getListPrefixes(kt *archivekey.Template, hostname string) []string {
+	prefix := kt.HostPrefix(hostname)
+	defaultPrefix := hostname + "/"
+
+	switch {
+	case strings.HasPrefix(defaultPrefix, prefix):
+		return []string{prefix}
+	case strings.HasPrefix(prefix, defaultPrefix):
+		return []string{defaultPrefix}
+	default:
+		return []string{prefix, defaultPrefix}
+	}
+}
+
+// Get the ID of the lifecycle rule that expires a job's archives on a host.
+func getLifecycleRuleId(hostname string, jobName string) string {
+	return fmt.Sprintf("%s-%s-%s", LIFECYCLE_ID, hostname, jobName)
+}
+
+// Get the settings to create a job's archive object with. The job's S3 settings are applied over the global ones and
+// the object is given metadata describing the run that created it.
+func getObjectOptions(jobConfig config.JobConfig, defaultObjectConfig config.S3ObjectConfig, metadata ArchiveMetadata) (s3ObjectOptions, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatal("Could not determine hostname.", err)
-		return ""
+		return s3ObjectOptions{}, err
+	}
+
+	objectConfig := jobConfig.GetS3ObjectConfig(defaultObjectConfig)
+
+	options := s3ObjectOptions{
+		Metadata: make(map[string]*string),
+	}
+
+	if objectConfig.StorageClass != "" {
+		options.StorageClass = aws.String(objectConfig.StorageClass)
+	}
+	if objectConfig.ServerSideEncryption != "" {
+		options.ServerSideEncryption = aws.String(objectConfig.ServerSideEncryption)
+	}
+	if objectConfig.KMSKeyId != "" {
+		options.SSEKMSKeyId = aws.String(objectConfig.KMSKeyId)
+	}
+
+	objectMetadata := map[string]string{
+		"frosty-job":      jobConfig.Name,
+		"frosty-run-id":   metadata.RunId,
+		"frosty-hostname": hostname,
+		"frosty-sha256":   metadata.Checksum,
+		"frosty-version":  metadata.FrostyVersion,
+	}
+	for k, v := range objectMetadata {
+		if v != "" {
+			options.Metadata[k] = aws.String(v)
+		}
+	}
+
+	tags := url.Values{}
+	for k, v := range objectConfig.Tags {
+		tags.Set(k, v)
 	}
+	tags.Set(TAG_KEY_HOSTNAME, hostname)
+	tags.Set(TAG_KEY_JOB, jobConfig.Name)
+	options.Tagging = aws.String(tags.Encode())
 
-	return fmt.Sprintf("%s/%s/%s_%s", hostname, time.Now().Format("20060102"), time.Now().Format("15:04:05"), fileName)
+	return options, nil
 }
@@ -0,0 +1,97 @@
+package backupservice
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/mleonard87/frosty/config"
+)
+
+// How S3 and Glacier destinations authenticate with AWS.
+type AWSCredentials struct {
+	// Used if both are given, otherwise credentials are found through the default chain of environment variables,
+	// shared config files, web identity tokens and the instance or task role.
+	AccessKeyId     string
+	SecretAccessKey string
+	// The named profile to use from the shared config files instead of the default profile.
+	Profile string
+	// Empty to use the region from the environment or profile.
+	Region string
+	// If set, this role is assumed using the credentials above.
+	RoleArn    string
+	ExternalId string
+}
+
+// Read the AWS credential settings of a destination. All of these are optional.
+func getAWSCredentials(backupConfig *config.BackupConfig) AWSCredentials {
+	var ac AWSCredentials
+
+	ac.AccessKeyId, _ = backupConfig.BackupConfig["accessKeyId"].(string)
+	ac.SecretAccessKey, _ = backupConfig.BackupConfig["secretAccessKey"].(string)
+	ac.Profile, _ = backupConfig.BackupConfig["profile"].(string)
+	ac.Region, _ = backupConfig.BackupConfig["region"].(string)
+	ac.RoleArn, _ = backupConfig.BackupConfig["roleArn"].(string)
+	ac.ExternalId, _ = backupConfig.BackupConfig["externalId"].(string)
+
+	return ac
+}
+
+// Create an AWS session from the credentials. Nothing is read from or written to the process environment other than
+// by the default credential chain, so credentials given in the config are never passed on to job commands.
+func (ac AWSCredentials) newSession() (*session.Session, error) {
+	options := session.Options{
+		Profile:           ac.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+
+	if ac.Region != "" {
+		options.Config.Region = aws.String(ac.Region)
+	}
+
+	if ac.AccessKeyId != "" && ac.SecretAccessKey != "" {
+		options.Config.Credentials = credentials.NewStaticCredentials(ac.AccessKeyId, ac.SecretAccessKey, "")
+	}
+
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating AWS session:\n%s\n", err)
+	}
+
+	if aws.StringValue(sess.Config.Region) == "" {
+		return nil, errors.New("No AWS region is configured. Set region in the config file, AWS_REGION in the environment or region in the AWS profile.")
+	}
+
+	if ac.RoleArn != "" {
+		sess = sess.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(sess, ac.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+				p.RoleSessionName = getRoleSessionName()
+				if ac.ExternalId != "" {
+					p.ExternalID = aws.String(ac.ExternalId)
+				}
+			}),
+		})
+	}
+
+	return sess, nil
+}
+
+// Get the session name for assumed roles so that CloudTrail shows which host frosty was running on.
+func getRoleSessionName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "frosty"
+	}
+
+	// Session names are limited to 64 characters.
+	name := "frosty-" + hostname
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
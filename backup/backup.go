@@ -1,52 +1,256 @@
 package backupservice
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/mleonard87/frosty/archivekey"
 	"github.com/mleonard87/frosty/config"
 )
 
-const (
-	BACKUP_NAME_PREFIX           = "frosty_"
-	ENVVAR_AWS_ACCESS_KEY_ID     = "AWS_ACCESS_KEY_ID"
-	ENVVAR_AWS_SECRET_ACCESS_KEY = "AWS_SECRET_ACCESS_KEY"
-	ENVVAR_AWS_REGION            = "AWS_REGION"
-)
+const BACKUP_NAME_PREFIX = "frosty_"
 
 type BackupService interface {
 	Name() string
 	SetConfig(backupConfig *config.BackupConfig)
-	Init() error
-	StoreFile(pathToFile string) error
-	ArtifactFilename(jobName string) string
+	Init(jobs []config.JobConfig) error
+	// Store the file, returning a description of the archive as it was stored. No more parts of a multipart upload
+	// are sent once the context is cancelled.
+	StoreFile(ctx context.Context, pathToFile string, jobConfig config.JobConfig, metadata ArchiveMetadata) (Archive, error)
 	BackupLocation() string
+	// List the archives stored for a job on a host, or for every job if jobName is empty. Stops waiting for anything
+	// that takes a long time, e.g. the inventory of a Glacier vault, once the context is cancelled.
+	ListArchives(ctx context.Context, hostname string, jobName string) ([]Archive, error)
+	RetrieveFile(ctx context.Context, archive Archive, pathToFile string) error
+	// Check that archives could be stored with the configured settings and credentials without storing anything,
+	// returning a description of what was found.
+	Check() (string, error)
+}
+
+// A backup service that keeps multipart uploads that fail part way through, so that the next attempt at storing the
+// same file carries on from the parts that were sent rather than starting again.
+type ResumableBackupService interface {
+	BackupService
+	// Abort the failed upload of a file that was kept for another attempt, if there is one. This is called once there
+	// will be no more attempts so that the parts that were sent are not kept (and charged for).
+	AbortUpload(pathToFile string)
+}
+
+// A backup service that frosty enforces retention for itself by deleting expired archives, rather than relying on the
+// service to expire them.
+type PrunableBackupService interface {
+	BackupService
+	// Get the number of days archives are kept for unless a job overrides it. 0 keeps archives indefinitely.
+	GetRetentionDays() int64
+	DeleteArchive(archive Archive) error
+}
+
+// An archive that has previously been stored by a backup service.
+type Archive struct {
+	Hostname  string
+	JobName   string
+	FileName  string
+	CreatedAt time.Time
+	Size      int64
+	// Where the archive is held by the backup service, e.g. the S3 bucket or Glacier vault name.
+	Container string
+	// What identifies the archive within its container, e.g. the S3 object key or Glacier archive ID.
+	Key string
+	// The description Glacier holds for the archive. Empty for other backup services.
+	Description string
+	// The SHA-256 tree hash of the archive as calculated by Glacier. Empty for other backup services.
+	Checksum string
+}
+
+// Details of the run that created an archive, stored alongside it by backup services that support metadata.
+type ArchiveMetadata struct {
+	RunId string
+	// The SHA-256 checksum of the archive.
+	Checksum      string
+	FrostyVersion string
+}
+
+// A named backup service that archives are sent to. There may be many destinations using the same type of backup
+// service, e.g. an on-site S3 compatible store and S3 itself.
+type Destination struct {
+	Name          string
+	BackupService BackupService
+}
+
+// Create a destination for each backup config in the frosty config.
+func NewDestinations(fc config.FrostyConfig) []Destination {
+	var destinations []Destination
+
+	for i := range fc.BackupConfigs {
+		destinations = append(destinations, Destination{
+			Name:          fc.BackupConfigs[i].Name,
+			BackupService: NewBackupService(&fc.BackupConfigs[i], fc),
+		})
+	}
+
+	return destinations
 }
 
-var currentBackupService BackupService
+// Find the destination with the given name.
+func FindDestination(destinations []Destination, name string) (Destination, bool) {
+	for _, d := range destinations {
+		if d.Name == name {
+			return d, true
+		}
+	}
 
-func NewBackupService(backupConfig *config.BackupConfig) BackupService {
+	return Destination{}, false
+}
+
+// Create the backup service for a backup config. Any global settings the backup service uses are taken from fc so that
+// they stay the same for as long as it is used, even if another config is loaded.
+func NewBackupService(backupConfig *config.BackupConfig, fc config.FrostyConfig) BackupService {
 	var bs BackupService
 
 	switch backupConfig.BackupService {
 	case config.BACKUP_SERVICE_AMAZON_GLACIER:
 		bs = &AmazonGlacierBackupService{}
 	case config.BACKUP_SERVICE_AMAZON_S3:
-		bs = &AmazonS3BackupService{}
+		bs = &AmazonS3BackupService{ObjectConfig: fc.S3}
+	case config.BACKUP_SERVICE_LOCAL:
+		bs = &LocalBackupService{}
 	default:
-		log.Fatal("Only Amazon Glacier and Amazon S3 are supported as a backup services.")
+		log.Fatal("Only Amazon Glacier, Amazon S3 and local are supported as backup services.")
 		return nil
 	}
 
 	bs.SetConfig(backupConfig)
 
-	currentBackupService = bs
-
 	return bs
 }
 
-func CurrentBackupService() *BackupService {
-	if currentBackupService == nil {
-		log.Fatal("You must create a backup service before calling CurrentbackupService().")
+// Write everything read from r into a new file at pathToFile.
+func writeFile(pathToFile string, r io.Reader) error {
+	f, err := os.Create(pathToFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Get the template for the keys archives are stored under in a destination. The template has already been checked
+// when the config was validated.
+func getKeyTemplate(backupConfig *config.BackupConfig) *archivekey.Template {
+	kt, err := backupConfig.GetKeyTemplate()
+	if err != nil {
+		log.Fatalf("Invalid key template for %q: %s", backupConfig.Name, err)
 	}
-	return &currentBackupService
+
+	return kt
+}
+
+// Describe a job's archive as it is about to be stored, including the key it is stored under. This is used as the S3
+// object key, the path within the local backup directory and the Glacier archive description so that archives can
+// be found by host, job, date and time.
+func newArchive(kt *archivekey.Template, jobName string, fileName string, runId string) (Archive, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return Archive{}, err
+	}
+
+	values := archivekey.Values{
+		Hostname:  hostname,
+		JobName:   jobName,
+		RunId:     runId,
+		FileName:  fileName,
+		CreatedAt: time.Now(),
+	}
+
+	// This fails if the key would be parsed back into different values, so that an archive is never stored where it
+	// would be listed, restored or pruned as though it belonged to another job.
+	key, err := kt.Key(values)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	// The archive is described as it will be when it is listed later on.
+	a, ok := parseObjectKey(kt, key)
+	if !ok {
+		return Archive{}, fmt.Errorf("the key %q can't be parsed back with the key template", key)
+	}
+
+	return a, nil
+}
+
+// Parse a key produced by newArchive back into the details of the archive it refers to. Returns false if the key is
+// not in the expected format and so was not stored by frosty.
+func parseObjectKey(kt *archivekey.Template, key string) (Archive, bool) {
+	values, ok := kt.Parse(key)
+	if !ok {
+		return Archive{}, false
+	}
+
+	return Archive{
+		Hostname:  values.Hostname,
+		JobName:   values.JobName,
+		FileName:  values.FileName,
+		CreatedAt: values.CreatedAt,
+		Key:       key,
+	}, true
+}
+
+// Get the size of the file at path in bytes.
+func getFileSize(path string) (int64, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return fileInfo.Size(), nil
+}
+
+// Check that files can be created in a directory by creating and removing an empty one. If the directory does not
+// exist yet the closest directory above it that does is checked instead, as it is created when it is first needed.
+func CheckDirectoryWritable(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	existing := dir
+	for {
+		fi, err := os.Stat(existing)
+		if err == nil {
+			if !fi.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", existing)
+			}
+			break
+		}
+		parent := filepath.Dir(existing)
+		if !os.IsNotExist(err) || parent == existing {
+			return "", err
+		}
+		existing = parent
+	}
+
+	f, err := ioutil.TempFile(existing, ".frosty-check-")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	if existing != dir {
+		return fmt.Sprintf("%s does not exist yet and can be created in %s", dir, existing), nil
+	}
+
+	return fmt.Sprintf("%s is writable", dir), nil
 }
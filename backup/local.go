@@ -0,0 +1,197 @@
+package backupservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mleonard87/frosty/archivekey"
+	"github.com/mleonard87/frosty/config"
+)
+
+type LocalBackupService struct {
+	Directory     string
+	RetentionDays int64
+	// The template for the paths of archives within the directory.
+	KeyTemplate *archivekey.Template
+}
+
+// Return the backup service type this must match the string as used as the JSON property in the frosty backup config.
+func (lbs *LocalBackupService) Name() string {
+	return config.BACKUP_SERVICE_LOCAL
+}
+
+// Initialise any variable needed for backups.
+func (lbs *LocalBackupService) SetConfig(backupConfig *config.BackupConfig) {
+	lbs.Directory = backupConfig.BackupConfig["directory"].(string)
+
+	// Attempt to get the retentionDays config property. If this can't be found then default to 0.
+	// 0 will keep backups indefinitely.
+	rd, ok := backupConfig.BackupConfig["retentionDays"]
+	if ok {
+		lbs.RetentionDays = int64(rd.(float64))
+	} else {
+		lbs.RetentionDays = 0
+	}
+
+	// keyTemplate and keyPrefix are optional.
+	lbs.KeyTemplate = getKeyTemplate(backupConfig)
+}
+
+// Initialise anything in the backup service that needs to be created prior to storing files. In this instance we need
+// to create the backup directory if it does not already exist.
+func (lbs *LocalBackupService) Init(jobs []config.JobConfig) error {
+	err := os.MkdirAll(lbs.Directory, 0755)
+	if err != nil {
+		log.Printf("Error creating backup directory %s\n", lbs.Directory)
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// Check that archives can be written to the backup directory.
+func (lbs *LocalBackupService) Check() (string, error) {
+	return CheckDirectoryWritable(lbs.Directory)
+}
+
+// Copy the file in pathToFile into the backup directory.
+func (lbs *LocalBackupService) StoreFile(ctx context.Context, pathToFile string, jobConfig config.JobConfig, metadata ArchiveMetadata) (Archive, error) {
+	_, fileName := filepath.Split(pathToFile)
+
+	a, err := newArchive(lbs.KeyTemplate, jobConfig.Name, fileName, metadata.RunId)
+	if err != nil {
+		return Archive{}, err
+	}
+	target := filepath.Join(lbs.Directory, filepath.FromSlash(a.Key))
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	err = copyFile(pathToFile, target)
+	if err != nil {
+		log.Printf("Failed to copy %s to %s\n", pathToFile, target)
+		log.Println(err)
+		return Archive{}, err
+	}
+
+	a.Container = lbs.Directory
+	a.Size, err = getFileSize(target)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	return a, nil
+}
+
+// Get a friendly name for the email template of where this backup was stored. In this case, the backup directory.
+func (lbs *LocalBackupService) BackupLocation() string {
+	return fmt.Sprintf("Directory: %s", lbs.Directory)
+}
+
+// List the archives stored in the backup directory for the given job on the given host.
+func (lbs *LocalBackupService) ListArchives(ctx context.Context, hostname string, jobName string) ([]Archive, error) {
+	archives, err := lbs.listAllArchives()
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []Archive
+
+	for _, a := range archives {
+		if a.Hostname == hostname && a.JobName == jobName {
+			matching = append(matching, a)
+		}
+	}
+
+	return matching, nil
+}
+
+// Copy the archive out of the backup directory into pathToFile.
+func (lbs *LocalBackupService) RetrieveFile(ctx context.Context, archive Archive, pathToFile string) error {
+	return copyFile(filepath.Join(archive.Container, filepath.FromSlash(archive.Key)), pathToFile)
+}
+
+// List every archive that frosty has stored in the backup directory.
+func (lbs *LocalBackupService) listAllArchives() ([]Archive, error) {
+	var archives []Archive
+
+	err := filepath.Walk(lbs.Directory, func(path string, f os.FileInfo, err error) error {
+		// The directory is only created when the first archive is stored so until then there are no archives.
+		if path == lbs.Directory && os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(lbs.Directory, path)
+		if err != nil {
+			return err
+		}
+
+		// Ignore anything in the directory that was not put there by frosty.
+		a, ok := parseObjectKey(lbs.KeyTemplate, filepath.ToSlash(rel))
+		if !ok {
+			return nil
+		}
+		a.Size = f.Size()
+		a.Container = lbs.Directory
+		archives = append(archives, a)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return archives, nil
+}
+
+// Get the number of days archives are kept for unless a job overrides it.
+func (lbs *LocalBackupService) GetRetentionDays() int64 {
+	return lbs.RetentionDays
+}
+
+// Remove the archive from the backup directory along with any directories left empty.
+func (lbs *LocalBackupService) DeleteArchive(archive Archive) error {
+	path := filepath.Join(archive.Container, filepath.FromSlash(archive.Key))
+
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	// Remove the directories above the archive up to the backup directory. Removing a directory only succeeds if it
+	// is empty so this stops at the first that still holds other archives.
+	dir := filepath.Dir(path)
+	for dir != filepath.Clean(archive.Container) && strings.HasPrefix(dir, filepath.Clean(archive.Container)) {
+		if os.Remove(dir) != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	return nil
+}
+
+// Copy the file at src to a new file at dst.
+func copyFile(src string, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeFile(dst, f)
+}
@@ -0,0 +1,118 @@
+package backupservice
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mleonard87/frosty/config"
+)
+
+func TestLocalStoreListRestore(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		keyTemplate string
+		keyPrefix   string
+	}{
+		{"default", "", ""},
+		{"default with prefix", "", "frosty/"},
+		{"run ID", "{{.JobName}}/{{.Hostname}}/{{.RunId}}-{{.FileName}}", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "frosty-local")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+
+			directory := filepath.Join(tmp, "backups")
+			bs := NewBackupService(&config.BackupConfig{
+				Name:          "local",
+				BackupService: config.BACKUP_SERVICE_LOCAL,
+				BackupConfig: map[string]interface{}{
+					"directory":   directory,
+					"keyTemplate": tt.keyTemplate,
+					"keyPrefix":   tt.keyPrefix,
+				},
+			}, config.FrostyConfig{})
+
+			ctx := context.Background()
+
+			// Nothing has been stored yet and the directory does not exist.
+			archives, err := bs.ListArchives(ctx, hostname, "postgres")
+			if err != nil {
+				t.Fatalf("ListArchives returned an error before anything was stored: %s", err)
+			}
+			if len(archives) != 0 {
+				t.Fatalf("ListArchives returned %d archives before anything was stored", len(archives))
+			}
+
+			err = bs.Init(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Archives of another job and a file frosty did not store are not listed.
+			stored := make(map[string]Archive)
+			for _, jobName := range []string{"postgres", "mysql"} {
+				pathToFile := filepath.Join(tmp, jobName+".zip")
+				err = ioutil.WriteFile(pathToFile, []byte(jobName+" artifacts"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				a, err := bs.StoreFile(ctx, pathToFile, config.JobConfig{Name: jobName}, ArchiveMetadata{RunId: "20170130140509"})
+				if err != nil {
+					t.Fatalf("StoreFile returned an error: %s", err)
+				}
+				stored[jobName] = a
+			}
+			err = ioutil.WriteFile(filepath.Join(directory, "notes.txt"), []byte("not an archive"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			archives, err = bs.ListArchives(ctx, hostname, "postgres")
+			if err != nil {
+				t.Fatalf("ListArchives returned an error: %s", err)
+			}
+			if len(archives) != 1 {
+				t.Fatalf("ListArchives returned %d archives, want 1: %+v", len(archives), archives)
+			}
+
+			a := archives[0]
+			want := stored["postgres"]
+			if a.Hostname != hostname || a.JobName != "postgres" || a.FileName != "postgres.zip" || a.Key != want.Key || a.Container != directory {
+				t.Errorf("ListArchives returned %+v, want %+v", a, want)
+			}
+			if a.Size != int64(len("postgres artifacts")) || a.Size != want.Size {
+				t.Errorf("ListArchives returned a size of %d, StoreFile returned %d, want %d", a.Size, want.Size, len("postgres artifacts"))
+			}
+			if !a.CreatedAt.Equal(want.CreatedAt) {
+				t.Errorf("ListArchives returned a creation time of %s, StoreFile returned %s", a.CreatedAt, want.CreatedAt)
+			}
+
+			restored := filepath.Join(tmp, "restored.zip")
+			err = bs.RetrieveFile(ctx, a, restored)
+			if err != nil {
+				t.Fatalf("RetrieveFile returned an error: %s", err)
+			}
+			data, err := ioutil.ReadFile(restored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "postgres artifacts" {
+				t.Errorf("RetrieveFile restored %q, want %q", data, "postgres artifacts")
+			}
+		})
+	}
+}
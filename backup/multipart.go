@@ -0,0 +1,222 @@
+package backupservice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mleonard87/frosty/config"
+)
+
+const (
+	BYTES_PER_MB = 1024 * 1024
+	// Used for parts of multipart uploads unless a destination configures otherwise.
+	DEFAULT_PART_SIZE_MB       = 16
+	DEFAULT_UPLOAD_CONCURRENCY = 4
+	// Both S3 and Glacier limit multipart uploads to this many parts.
+	MAX_UPLOAD_PARTS = 10000
+	// How many times a part is attempted before the whole upload is abandoned, and how long to wait before retrying.
+	PART_UPLOAD_ATTEMPTS      = 3
+	PART_UPLOAD_RETRY_BACKOFF = 5 * time.Second
+)
+
+// A part of a file being sent in a multipart upload.
+type uploadPart struct {
+	// Parts are numbered from 1.
+	Number int
+	Offset int64
+	Size   int64
+}
+
+// A multipart upload that failed part way through, kept so that the next attempt at storing the same file only sends
+// the parts that were not sent.
+type pendingUpload struct {
+	// The archive being uploaded. It is stored under the same key however many attempts it takes.
+	Archive  Archive
+	UploadId string
+	Size     int64
+	PartSize int64
+	// What is needed to complete the upload for each part that was sent, e.g. its S3 ETag or Glacier tree hash, by
+	// part number - 1. Empty for parts that have not been sent.
+	Sent []string
+}
+
+// The multipart uploads of a backup service that failed part way through, by the path of the file being uploaded.
+type pendingUploads struct {
+	sync.Mutex
+	uploads map[string]pendingUpload
+}
+
+// Remove and return the failed upload of a file, if there is one.
+func (pu *pendingUploads) take(pathToFile string) (pendingUpload, bool) {
+	pu.Lock()
+	defer pu.Unlock()
+
+	upload, ok := pu.uploads[pathToFile]
+	delete(pu.uploads, pathToFile)
+	return upload, ok
+}
+
+// Keep the failed upload of a file for the next attempt at storing it.
+func (pu *pendingUploads) keep(pathToFile string, upload pendingUpload) {
+	pu.Lock()
+	defer pu.Unlock()
+
+	if pu.uploads == nil {
+		pu.uploads = make(map[string]pendingUpload)
+	}
+	pu.uploads[pathToFile] = upload
+}
+
+// Get the parts of the upload that have not been sent.
+func (upload pendingUpload) unsentParts(parts []uploadPart) []uploadPart {
+	var unsent []uploadPart
+	for _, part := range parts {
+		if upload.Sent[part.Number-1] == "" {
+			unsent = append(unsent, part)
+		}
+	}
+	return unsent
+}
+
+// Count the parts of the upload that have been sent.
+func (upload pendingUpload) sentCount() int {
+	count := 0
+	for _, s := range upload.Sent {
+		if s != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// Get the part size and concurrency configured for a destination, falling back to the defaults if they are not set.
+func getUploadOptions(backupConfig *config.BackupConfig) (int64, int) {
+	partSize := int64(DEFAULT_PART_SIZE_MB * BYTES_PER_MB)
+	ps, ok := backupConfig.BackupConfig["partSizeMB"]
+	if ok {
+		partSize = int64(ps.(float64)) * BYTES_PER_MB
+	}
+
+	concurrency := DEFAULT_UPLOAD_CONCURRENCY
+	uc, ok := backupConfig.BackupConfig["uploadConcurrency"]
+	if ok {
+		concurrency = int(uc.(float64))
+	}
+
+	return partSize, concurrency
+}
+
+// Get the part size to upload a file with. The configured size is doubled until the file fits within the maximum
+// number of parts, which keeps it a power of two MB as Glacier requires.
+func fitPartSize(fileSize int64, partSize int64) int64 {
+	for fileSize > partSize*MAX_UPLOAD_PARTS {
+		partSize *= 2
+	}
+	return partSize
+}
+
+// Split a file into parts of partSize bytes. The last part holds whatever is left over.
+func splitParts(fileSize int64, partSize int64) []uploadPart {
+	var parts []uploadPart
+
+	for offset := int64(0); offset < fileSize; offset += partSize {
+		size := partSize
+		if offset+size > fileSize {
+			size = fileSize - offset
+		}
+		parts = append(parts, uploadPart{
+			Number: len(parts) + 1,
+			Offset: offset,
+			Size:   size,
+		})
+	}
+
+	return parts
+}
+
+// Send the parts of the file with up to concurrency parts in flight at once. Each part is read straight from the file
+// so only the parts being sent are held in memory. A part that fails is retried on its own rather than restarting the
+// whole upload, and once a part has failed PART_UPLOAD_ATTEMPTS times no more parts are started and its error is
+// returned. Once the context is cancelled no more parts or retries are started and the context's error is returned.
+func uploadParts(ctx context.Context, f *os.File, parts []uploadPart, concurrency int, upload func(part uploadPart, body io.ReadSeeker) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ch := make(chan uploadPart)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var uploadErr error
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr != nil
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for part := range ch {
+				if failed() {
+					continue
+				}
+
+				err := uploadPartWithRetries(ctx, f, part, upload)
+				if err != nil {
+					mu.Lock()
+					if uploadErr == nil {
+						uploadErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, part := range parts {
+		if failed() || ctx.Err() != nil {
+			break
+		}
+		ch <- part
+	}
+	close(ch)
+
+	wg.Wait()
+
+	if uploadErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return uploadErr
+}
+
+// Send a single part, retrying it if it fails.
+func uploadPartWithRetries(ctx context.Context, f *os.File, part uploadPart, upload func(part uploadPart, body io.ReadSeeker) error) error {
+	var err error
+
+	for attempt := 1; attempt <= PART_UPLOAD_ATTEMPTS; attempt++ {
+		if attempt > 1 {
+			log.Printf("Retrying part %d of %s after failed attempt %d:\n%s\n", part.Number, f.Name(), attempt-1, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(PART_UPLOAD_RETRY_BACKOFF * time.Duration(attempt-1)):
+			}
+		}
+
+		err = upload(part, io.NewSectionReader(f, part.Offset, part.Size))
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("part %d of %s failed after %d attempts: %s", part.Number, f.Name(), PART_UPLOAD_ATTEMPTS, err)
+}
@@ -1,56 +1,311 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
-
+	"os/signal"
+	"strings"
 	"sync"
-
+	"syscall"
 	"time"
 
 	flag "github.com/ogier/pflag"
 
 	"github.com/mleonard87/frosty/backup"
 	"github.com/mleonard87/frosty/config"
+	"github.com/mleonard87/frosty/history"
 	"github.com/mleonard87/frosty/job"
+	"github.com/mleonard87/frosty/prune"
 	"github.com/mleonard87/frosty/reporting"
-	"gopkg.in/robfig/cron.v2"
 )
 
 var frostyVersion string
 
 const (
-	COMMAND_BACKUP   = "backup"
-	COMMAND_HELP     = "help"
-	COMMAND_VALIDATE = "validate"
-	COMMAND_VERSION  = "version"
+	COMMAND_BACKUP            = "backup"
+	COMMAND_GLACIER_INVENTORY = "glacier-inventory"
+	COMMAND_HELP              = "help"
+	COMMAND_HISTORY           = "history"
+	COMMAND_LIST_ARCHIVES     = "list-archives"
+	COMMAND_PRUNE             = "prune"
+	COMMAND_RESTORE           = "restore"
+	COMMAND_RUN               = "run"
+	COMMAND_VALIDATE          = "validate"
+	COMMAND_VERSION           = "version"
 )
 
+// A frosty subcommand. Each subcommand parses its own flags from the arguments that follow its name.
+type subcommand struct {
+	usage       string
+	description string
+	execute     func(args []string)
+}
+
+var subcommands map[string]subcommand
+
+// The order subcommands are listed in the help.
+var subcommandNames = []string{
+	COMMAND_BACKUP,
+	COMMAND_RUN,
+	COMMAND_RESTORE,
+	COMMAND_HISTORY,
+	COMMAND_LIST_ARCHIVES,
+	COMMAND_GLACIER_INVENTORY,
+	COMMAND_PRUNE,
+	COMMAND_VALIDATE,
+	COMMAND_VERSION,
+	COMMAND_HELP,
+}
+
+// The subcommands are set up here rather than where they are declared as the help subcommand refers back to them.
+func init() {
+	subcommands = map[string]subcommand{
+		COMMAND_BACKUP: {
+			usage:       "<path-to-frosty-config-file>",
+			description: "Run each job according to its schedule until stopped. This is the default if no subcommand is given.",
+			execute:     executeBackup,
+		},
+		COMMAND_RUN: {
+			usage:       "<path-to-frosty-config-file> [--job <job-name>...]",
+			description: "Run jobs once, immediately, and exit.",
+			execute:     executeRun,
+		},
+		COMMAND_RESTORE: {
+			usage:       "<path-to-frosty-config-file> --job <job-name> [--destination <name>] [--at <timestamp>] [--host <hostname>] --to <dir>",
+			description: "Download a job's archive and extract it.",
+			execute:     executeRestore,
+		},
+		COMMAND_HISTORY: {
+			usage:       "<path-to-frosty-config-file> [--job <job-name>...] [--since <timestamp>] [--failed] [--output table|json]",
+			description: "Show the jobs run on this host, newest first.",
+			execute:     executeHistory,
+		},
+		COMMAND_LIST_ARCHIVES: {
+			usage:       "<path-to-frosty-config-file> [--job <job-name>...] [--destination <name>] [--host <hostname>] [--output table|json]",
+			description: "List the archives stored in the backup destinations.",
+			execute:     executeListArchives,
+		},
+		COMMAND_GLACIER_INVENTORY: {
+			usage:       "<path-to-frosty-config-file> [--destination <name>] [--vault <name>] [--output table|json]",
+			description: "Retrieve the inventory of Glacier vaults and check it against the uploads in the run history.",
+			execute:     executeGlacierInventory,
+		},
+		COMMAND_PRUNE: {
+			usage:       "<path-to-frosty-config-file> [--job <job-name>...] [--destination <name>] [--dry-run] [--output table|json]",
+			description: "Delete archives on this host that are older than their retention period. This also happens after each run.",
+			execute:     executePrune,
+		},
+		COMMAND_VALIDATE: {
+			usage:       "<path-to-frosty-config-file> [--deep]",
+			description: "Validate a config file, and with --deep check that everything it relies on can be reached.",
+			execute:     executeValidate,
+		},
+		COMMAND_VERSION: {
+			description: "Print the version of frosty.",
+			execute:     executeVersion,
+		},
+		COMMAND_HELP: {
+			usage:       "[<subcommand>]",
+			description: "Print help for frosty or one of its subcommands.",
+			execute:     executeHelp,
+		},
+	}
+}
+
 func Execute() {
-	flag.Usage = printHelp
+	// Keep any secrets resolved from the config file out of the logs.
+	log.SetOutput(config.NewRedactingWriter(os.Stderr))
 
-	doValidate := flag.Bool("validate", false, "Validates that the specified config file is valid.")
-	doVersion := flag.Bool("version", false, "Prints the version information about the Frosty backup utility.")
+	args := os.Args[1:]
 
-	flag.Parse()
+	if len(args) > 0 {
+		if sc, ok := subcommands[args[0]]; ok {
+			sc.execute(args[1:])
+			return
+		}
+	}
+
+	executeLegacy(args)
+}
+
+// Older versions of frosty only took a config file and the --validate and --version flags rather than a subcommand.
+// These are still accepted and treated as the backup, validate and version subcommands.
+func executeLegacy(args []string) {
+	fs := flag.NewFlagSet(COMMAND_BACKUP, flag.ExitOnError)
+	fs.Usage = printHelp
+	doValidate := fs.Bool("validate", false, "Validates that the specified config file is valid.")
+	deep := fs.Bool("deep", false, "With --validate, also check that job commands, the SMTP server and the backup destinations can be reached.")
+	doVersion := fs.Bool("version", false, "Prints the version information about the Frosty backup utility.")
+	fs.Parse(args)
 
 	switch {
 	case *doValidate:
-		validate(os.Args[1])
+		validate(requireConfigPath(fs), *deep)
 	case *doVersion:
 		printVersion()
 	default:
-		backup(os.Args[1])
+		backup(requireConfigPath(fs))
+	}
+}
+
+func executeBackup(args []string) {
+	fs := newFlagSet(COMMAND_BACKUP)
+	fs.Parse(args)
+
+	backup(requireConfigPath(fs))
+}
+
+func executeRun(args []string) {
+	fs := newFlagSet(COMMAND_RUN)
+	var jobNames stringList
+	fs.Var(&jobNames, "job", "Only run the named job. May be given more than once. Default is all jobs.")
+	fs.Parse(args)
+
+	run(requireConfigPath(fs), jobNames)
+}
+
+func executeRestore(args []string) {
+	fs := newFlagSet(COMMAND_RESTORE)
+	jobName := fs.String("job", "", "The name of the job to restore.")
+	restoreAt := fs.String("at", "", "Restore the newest archive stored at or before this time (e.g. 20170130010000). Default is the newest archive.")
+	restoreTo := fs.String("to", "", "The directory the archive will be extracted into.")
+	restoreHost := fs.String("host", "", "Restore an archive stored by a different host. Default is this host.")
+	restoreFrom := fs.String("destination", "", "The name of the backup destination to restore from. Only needed if there is more than one.")
+	fs.Parse(args)
+
+	restore(requireConfigPath(fs), *jobName, *restoreFrom, *restoreHost, *restoreAt, *restoreTo)
+}
+
+func executeHistory(args []string) {
+	fs := newFlagSet(COMMAND_HISTORY)
+	var jobNames stringList
+	fs.Var(&jobNames, "job", "Only show the named job. May be given more than once. Default is all jobs.")
+	since := fs.String("since", "", "Only show jobs started at or after this time (e.g. 20170130010000 or 2017-01-30) or within this duration (e.g. 72h).")
+	failed := fs.Bool("failed", false, "Only show jobs that did not succeed.")
+	output := fs.String("output", OUTPUT_FORMAT_TABLE, "The output format, either \"table\" or \"json\".")
+	fs.Parse(args)
+
+	showHistory(requireConfigPath(fs), jobNames, *since, *failed, *output)
+}
+
+func executeListArchives(args []string) {
+	fs := newFlagSet(COMMAND_LIST_ARCHIVES)
+	var jobNames stringList
+	fs.Var(&jobNames, "job", "Only list archives for the named job. May be given more than once. Default is all jobs.")
+	destinationName := fs.String("destination", "", "Only list archives in the named backup destination. Default is all destinations.")
+	hostname := fs.String("host", "", "List archives stored by a different host. Default is this host.")
+	output := fs.String("output", OUTPUT_FORMAT_TABLE, "The output format, either \"table\" or \"json\".")
+	fs.Parse(args)
+
+	listArchives(requireConfigPath(fs), jobNames, *destinationName, *hostname, *output)
+}
+
+func executeGlacierInventory(args []string) {
+	fs := newFlagSet(COMMAND_GLACIER_INVENTORY)
+	destinationName := fs.String("destination", "", "Only check the named Glacier backup destination. Default is all Glacier destinations.")
+	vaultName := fs.String("vault", "", "Only check the named vault. Default is the configured vault and every vault uploads have been recorded in.")
+	output := fs.String("output", OUTPUT_FORMAT_TABLE, "The output format, either \"table\" or \"json\".")
+	fs.Parse(args)
+
+	glacierInventory(requireConfigPath(fs), *destinationName, *vaultName, *output)
+}
+
+func executePrune(args []string) {
+	fs := newFlagSet(COMMAND_PRUNE)
+	var jobNames stringList
+	fs.Var(&jobNames, "job", "Only prune archives for the named job. May be given more than once. Default is all jobs.")
+	destinationName := fs.String("destination", "", "Only prune archives in the named backup destination. Default is all destinations.")
+	dryRun := fs.Bool("dry-run", false, "Show what would be deleted without deleting anything.")
+	output := fs.String("output", OUTPUT_FORMAT_TABLE, "The output format, either \"table\" or \"json\".")
+	fs.Parse(args)
+
+	pruneArchives(requireConfigPath(fs), jobNames, *destinationName, *dryRun, *output)
+}
+
+func executeValidate(args []string) {
+	fs := newFlagSet(COMMAND_VALIDATE)
+	deep := fs.Bool("deep", false, "Also check that job commands can be found, the work directory is writable, the SMTP server accepts the credentials and the backup destinations can be reached. Nothing is run, sent or stored.")
+	fs.Parse(args)
+
+	validate(requireConfigPath(fs), *deep)
+}
+
+func executeVersion(args []string) {
+	fs := newFlagSet(COMMAND_VERSION)
+	fs.Parse(args)
+
+	printVersion()
+}
+
+func executeHelp(args []string) {
+	fs := newFlagSet(COMMAND_HELP)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		printHelp()
+		return
 	}
+
+	if _, ok := subcommands[fs.Arg(0)]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %q.\n\n", fs.Arg(0))
+		printHelp()
+		os.Exit(2)
+	}
+
+	// Each subcommand prints its own usage when asked for help.
+	subcommands[fs.Arg(0)].execute([]string{"--help"})
+}
+
+// Create the flag set for a subcommand. Its usage shows how to run the subcommand followed by its flags.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		sc := subcommands[name]
+		fmt.Fprintf(os.Stderr, "Usage of %s %s:\n", os.Args[0], name)
+		fmt.Fprintf(os.Stderr, "\n\tfrosty %s %s\n\n%s\n", name, sc.usage, sc.description)
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Get the path to the config file given as the first argument after the flags, exiting with the usage if it is
+// missing.
+func requireConfigPath(fs *flag.FlagSet) string {
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Arg(0)
+}
+
+// A flag value that collects every occurrence of a repeatable string flag.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+func (sl *stringList) Type() string {
+	return "string"
 }
 
 // Print usage information about the frosty backup tool.
 func printHelp() {
-	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "\n\tfrosty <path-to-frosty-config-file> [flags...]\n\n")
-	fmt.Fprintf(os.Stderr, "Flags:\n")
-	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n\n", os.Args[0])
+	for _, name := range subcommandNames {
+		sc := subcommands[name]
+		fmt.Fprintf(os.Stderr, "\tfrosty %s %s\n", name, sc.usage)
+		fmt.Fprintf(os.Stderr, "\t\t%s\n", sc.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun \"frosty help <subcommand>\" for the flags each subcommand accepts.\n")
 	fmt.Fprintf(os.Stderr, "\n%s\n", frostyVersion)
 }
 
@@ -59,11 +314,23 @@ func printVersion() {
 	fmt.Fprintf(os.Stderr, "Frosty backup utility, version %s\n", frostyVersion)
 }
 
-// Validate a given config file.
-func validate(configPath string) {
-	_, err := config.LoadConfig(configPath)
-	if err != nil {
-		log.Fatalf("Frosty config file: %v - FAILED\n", configPath)
+// Validate a given config file. If deep is set the jobs, SMTP server and destinations it configures are also checked.
+func validate(configPath string, deep bool) {
+	fc, err := config.LoadConfig(configPath)
+	if ve, ok := err.(*config.ValidationError); ok {
+		for _, p := range ve.Problems {
+			log.Println(p)
+		}
+		log.Printf("Frosty config file: %v - FAILED with %d problem(s)\n", configPath, len(ve.Problems))
+		os.Exit(1)
+	} else if err != nil {
+		log.Println(err)
+		log.Printf("Frosty config file: %v - FAILED\n", configPath)
+		os.Exit(1)
+	}
+
+	if deep && !preflight(fc) {
+		log.Printf("Frosty config file: %v - FAILED deep validation\n", configPath)
 		os.Exit(1)
 	}
 
@@ -71,7 +338,8 @@ func validate(configPath string) {
 }
 
 // The main function for beginning backups. This is the default way in which frosty will run. It loads a config file
-// and then execute all the backups.
+// and then execute all the backups. The config file is reloaded on SIGHUP without interrupting any running jobs. On
+// SIGINT or SIGTERM no more jobs are started and frosty exits once the running jobs have finished or been interrupted.
 func backup(configPath string) {
 	fc, err := config.LoadConfig(configPath)
 	if err != nil {
@@ -79,60 +347,127 @@ func backup(configPath string) {
 		os.Exit(1)
 	}
 
-	bs := backupservice.NewBackupService(&fc.BackupConfig)
-	sj := fc.ScheduledJobs()
+	s := newScheduler(configPath)
+	err = s.update(fc)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	s.start()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-reload:
+			s.reload()
+		case sig := <-stop:
+			log.Printf("Received %s, stopping frosty\n", sig)
+			s.shutdown(stop)
+			log.Println("Frosty stopped")
+			return
+		}
+	}
+}
 
-	scheduleJobs(sj, bs, fc)
+// Run the selected jobs (or all jobs if none are selected) once, immediately, rather than waiting for their schedule.
+// This exits with a non-zero status if any of the jobs failed so that it can be driven by external schedulers.
+func run(configPath string, jobNames []string) {
+	fc, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
 
-	select {}
-}
+	jobs, err := selectJobs(fc.Jobs, jobNames)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
 
-// For the given map of cron schedule times against the list of jobs due to run at this time raise a gocron job
-// to execute each of these jobs in go routines at the given time.
-func scheduleJobs(js map[string][]config.JobConfig, bs backupservice.BackupService, fc config.FrostyConfig) {
-	c := cron.New()
+	ds := backupservice.NewDestinations(fc)
 
-	for k, v := range js {
-		// Assign v to jobs to use in the closure below.
-		jobs := v
+	js := runJobs(context.Background(), jobs, ds, fc)
 
-		// The function defined below acts as a closure using the assigned "jobs" variable above.
-		// If we do not re-assign v to jobs as above and constantly used "v" in the function then
-		// we would find that only the last set of jobs would ever be run as the value of "v" is
-		// updated in each iteration of the loop. However, jobs is scoped within the body of the
-		// loop and the closure below can take advantage of this.
-		_, err := c.AddFunc(k, func() {
-			// Get a timestamp as an ID for this run of jobs. This will be used in the directory name to ensure that
-			// if jobs overlap we don't get any conflicts.
-			t := time.Now()
-			runId := t.Format("20060102150405")
+	for _, j := range js {
+		if !j.IsSuccessful() {
+			os.Exit(1)
+		}
+	}
+}
 
-			js := beginJobs(jobs, runId)
-			initBackupService(bs, js)
-			beginBackups(bs, js, runId)
+// Return the jobs from the config with the given names. If no names are given then all jobs are returned.
+func selectJobs(jobs []config.JobConfig, jobNames []string) ([]config.JobConfig, error) {
+	if len(jobNames) == 0 {
+		return jobs, nil
+	}
 
-			if &fc.ReportingConfig.Email != nil {
-				reporting.SendEmailSummary(js, &fc.ReportingConfig.Email)
+	var selected []config.JobConfig
+	for _, name := range jobNames {
+		found := false
+		for _, j := range jobs {
+			if j.Name == name {
+				selected = append(selected, j)
+				found = true
+				break
 			}
-		})
+		}
+		if !found {
+			return nil, fmt.Errorf("No job named %q found in config file.", name)
+		}
+	}
 
+	return selected, nil
+}
+
+// Run a single batch of jobs: execute each job, transfer the resulting artifacts to every destination and send the
+// email report. The status of each job is returned once everything has finished. If the context is cancelled the
+// jobs that are still running are interrupted and no further transfers are started, but the batch is still recorded,
+// reported and cleaned up.
+func runJobs(ctx context.Context, jobs []config.JobConfig, ds []backupservice.Destination, fc config.FrostyConfig) []job.JobStatus {
+	// Get a timestamp as an ID for this run of jobs. This will be used in the directory name to ensure that
+	// if jobs overlap we don't get any conflicts.
+	t := time.Now()
+	runId := t.Format("20060102150405")
+
+	js := beginJobs(ctx, jobs, fc, runId)
+	ready := initDestinations(ds, js)
+	beginBackups(ctx, ready, js, fc, runId)
+
+	err := history.RecordRun(job.GetWorkDirectoryPath(fc), history.NewRunRecord(runId, t, time.Now(), js))
+	if err != nil {
+		log.Printf("Error recording run %s in the history catalog:\n%s\n", runId, err)
+	}
+
+	// Remove anything that has passed its retention period now that these jobs have been backed up again. This is
+	// left for the next batch if frosty is stopping.
+	if ctx.Err() == nil {
+		_, err = prune.Prune(ctx, ready, jobs, fc, false)
 		if err != nil {
-			log.Fatalf("Error scheduling jobs: %s", err.Error())
+			log.Printf("Error removing expired backups:\n%s\n", err)
 		}
 	}
 
-	c.Start()
+	if fc.ReportingConfig.Email.IsEnabled() {
+		reporting.SendEmailSummary(js, ds, &fc.ReportingConfig.Email)
+	}
+
+	return js
 }
 
 // Starts running all jobs by executing the commands and letting each command create its artifacts. This function
 // returns when all jobs have finished. Each job is run in a separate go routine.
-func beginJobs(jobs []config.JobConfig, runId string) []job.JobStatus {
+func beginJobs(ctx context.Context, jobs []config.JobConfig, fc config.FrostyConfig, runId string) []job.JobStatus {
 	ch := make(chan job.JobStatus)
 	var wg sync.WaitGroup
 
 	for _, j := range jobs {
 		wg.Add(1)
-		go beginJob(j, runId, ch, &wg)
+		go beginJob(ctx, j, fc, runId, ch, &wg)
 	}
 
 	go func() {
@@ -150,75 +485,184 @@ func beginJobs(jobs []config.JobConfig, runId string) []job.JobStatus {
 }
 
 // Run an individual job.
-func beginJob(jobConfig config.JobConfig, runId string, ch chan job.JobStatus, wg *sync.WaitGroup) {
+func beginJob(ctx context.Context, jobConfig config.JobConfig, fc config.FrostyConfig, runId string, ch chan job.JobStatus, wg *sync.WaitGroup) {
 	log.Printf("Running Job: %s\n", jobConfig.Name)
 	defer wg.Done()
-	js := job.Start(jobConfig, runId)
+	js := job.Start(ctx, jobConfig, fc, runId)
 	ch <- js
 }
 
-// Initialise the backup service (e.g. S3 or Glacier) if there was a problem doing this mark all jobs as failed and
-// write the error message to each job.
-func initBackupService(backupService backupservice.BackupService, jobStatuses []job.JobStatus) error {
-	err := backupService.Init()
+// Initialise each destination's backup service (e.g. S3 or Glacier) for the jobs that use it. If there was a problem
+// doing this then a failed transfer to that destination is recorded against each of those jobs. The destinations that
+// are ready to use are returned. Destinations that are not used by any of the jobs are not initialised.
+func initDestinations(destinations []backupservice.Destination, jobStatuses []job.JobStatus) []backupservice.Destination {
+	var ready []backupservice.Destination
+
+	for _, d := range destinations {
+		var jobs []config.JobConfig
+		for _, js := range jobStatuses {
+			if js.JobConfig.UsesDestination(d.Name) {
+				jobs = append(jobs, js.JobConfig)
+			}
+		}
 
-	if err != nil {
-		for i := range jobStatuses {
-			// If we couldn't init the backup service then just log the same error caused by that against
-			// each job. This saves needing to create a generic section in the email reporting that covers
-			// over-arching backup service errors.
-			jobStatuses[i].Status = job.STATUS_FAILURE
-			jobStatuses[i].TransferError = err.Error()
+		if len(jobs) == 0 {
 			continue
 		}
 
-		return err
+		err := d.BackupService.Init(jobs)
+		if err != nil {
+			for i, js := range jobStatuses {
+				// If we couldn't init the backup service then just log the same error caused by that against
+				// each job. This saves needing to create a generic section in the email reporting that covers
+				// over-arching backup service errors.
+				if js.JobConfig.UsesDestination(d.Name) {
+					jobStatuses[i].AddTransfer(newTransferStatus(d, err.Error()))
+				}
+			}
+			continue
+		}
+
+		ready = append(ready, d)
 	}
 
-	return nil
+	return ready
 }
 
-// Begin the transfer of artifacts to the backup service.
-func beginBackups(backupService backupservice.BackupService, jobStatuses []job.JobStatus, runId string) {
+// Begin the transfer of artifacts to every destination used by each job. Once the context is cancelled no more
+// transfers are started and the jobs whose archives have not been transferred everywhere are interrupted. A transfer
+// that has already started sends no more parts, although a file sent in a single request is left to finish. The
+// archive of an interrupted job that was not transferred anywhere is kept like any other.
+func beginBackups(ctx context.Context, destinations []backupservice.Destination, jobStatuses []job.JobStatus, fc config.FrostyConfig, runId string) {
+	// Whether the artifacts of any job have been left in the run directory.
+	retained := false
+
 	for i, js := range jobStatuses {
-		archivePath := job.GetArtifactArchiveTargetName(js.JobConfig.Name, runId)
+		// Jobs that failed before creating an archive, or had no artifacts to archive, have nothing to transfer.
+		if !js.ArchiveCreated {
+			removeJobDirectory(jobStatuses, i, fc, runId)
+			continue
+		}
 
-		// Only run the backup if the archive exists.
+		archivePath := js.ArchivePath
+
+		// The archive was created so it must still be there to be transferred. A job that has already failed keeps
+		// the error that caused it.
 		_, err := os.Stat(archivePath)
 		if err != nil {
-			if !os.IsNotExist(err) {
+			if js.IsSuccessful() {
 				em := fmt.Sprintf("Error locating artifacts at \"%s\":\n%s\n", archivePath, err)
 				jobStatuses[i].Status = job.STATUS_FAILURE
-				jobStatuses[i].TransferError = em
-				continue
-			} else {
-				continue
+				jobStatuses[i].Error = em
 			}
+			retained = true
+			continue
 		}
 
-		jobStatuses[i].TransferStartTime = time.Now()
-		err = backupService.StoreFile(archivePath)
-		if err != nil {
-			jobStatuses[i].Status = job.STATUS_FAILURE
-			jobStatuses[i].TransferError = err.Error()
-			continue
+		metadata := backupservice.ArchiveMetadata{
+			RunId:         runId,
+			Checksum:      js.ArchiveChecksum,
+			FrostyVersion: frostyVersion,
 		}
-		jobStatuses[i].TransferEndTime = time.Now()
 
-		// Remove the directory created for this job.
-		err = job.RemoveJobDirectory(js.JobConfig.Name, runId)
-		if err != nil {
-			em := fmt.Sprintf("Unable to remove working directory for %s job following successful transfer:\n%s\n", js.JobConfig.Name, err)
-			js.Status = job.STATUS_FAILURE
-			js.Error = em
-			js.EndTime = time.Now()
+		for _, d := range destinations {
+			if !js.JobConfig.UsesDestination(d.Name) {
+				continue
+			}
+
+			if ctx.Err() != nil {
+				jobStatuses[i].Status = job.STATUS_INTERRUPTED
+				jobStatuses[i].Error = fmt.Sprintf("Job was interrupted before its archive was transferred to %s.", d.Name)
+				break
+			}
+
+			ts := storeArchive(ctx, d, archivePath, js.JobConfig, fc, metadata)
+			jobStatuses[i].AddTransfer(ts)
+			if !ts.IsSuccessful() && ctx.Err() != nil {
+				jobStatuses[i].Status = job.STATUS_INTERRUPTED
+			}
+		}
+
+		// Keep the archive if it could not be transferred anywhere as it would otherwise be lost.
+		if !jobStatuses[i].HasSuccessfulTransfer() {
+			log.Printf("The archive for %s job was not transferred to any destination and has been kept at \"%s\"\n", js.JobConfig.Name, archivePath)
+			retained = true
 			continue
 		}
+
+		removeJobDirectory(jobStatuses, i, fc, runId)
 	}
 
-	// Finally remove the run directory (this should be empty by this point).
-	err := job.RemoveRunDirectory(runId)
+	// Finally remove the run directory, which is empty by this point unless the artifacts of a job have been kept.
+	if retained {
+		return
+	}
+	err := job.RemoveRunDirectory(fc, runId)
 	if err != nil {
 		log.Printf("Error removing run directory \"%s\":\n%s\n", runId, err)
 	}
 }
+
+// Remove the directory created for a job, failing the job if it cannot be removed.
+func removeJobDirectory(jobStatuses []job.JobStatus, i int, fc config.FrostyConfig, runId string) {
+	err := job.RemoveJobDirectory(jobStatuses[i].JobConfig.Name, fc, runId)
+	if err != nil {
+		em := fmt.Sprintf("Unable to remove working directory for %s job following transfer:\n%s\n", jobStatuses[i].JobConfig.Name, err)
+		jobStatuses[i].Status = job.STATUS_FAILURE
+		jobStatuses[i].Error = em
+	}
+}
+
+// Store the archive in the destination, retrying the transfer as configured for the job if it fails. There are no
+// more retries once the context is cancelled.
+func storeArchive(ctx context.Context, destination backupservice.Destination, archivePath string, jobConfig config.JobConfig, fc config.FrostyConfig, metadata backupservice.ArchiveMetadata) job.TransferStatus {
+	retries, retryBackoff := job.GetRetryPolicy(jobConfig, fc)
+	ts := newTransferStatus(destination, "")
+
+	// A multipart upload that fails part way through is carried on by the next attempt, so it is only aborted once
+	// there are no more attempts.
+	if rbs, ok := destination.BackupService.(backupservice.ResumableBackupService); ok {
+		defer rbs.AbortUpload(archivePath)
+	}
+
+	for attempt := 1; ; attempt++ {
+		ts.StartTime = time.Now()
+		a, err := destination.BackupService.StoreFile(ctx, archivePath, jobConfig, metadata)
+		ts.EndTime = time.Now()
+
+		if err == nil {
+			ts.Container = a.Container
+			ts.Key = a.Key
+			ts.Description = a.Description
+			ts.Checksum = a.Checksum
+			ts.Error = ""
+			return ts
+		}
+
+		ts.Error = err.Error()
+		if attempt > retries {
+			return ts
+		}
+
+		ts.FailedAttempts = append(ts.FailedAttempts, job.FailedAttempt{
+			StartTime: ts.StartTime,
+			EndTime:   ts.EndTime,
+			Error:     ts.Error,
+		})
+		log.Printf("Attempt %d of transfer of %s to %s failed, retrying:\n%s\n", attempt, archivePath, destination.Name, ts.Error)
+
+		if !job.WaitForRetry(ctx, retryBackoff, attempt) {
+			ts.Error = "Transfer was stopped before it could be retried."
+			return ts
+		}
+	}
+}
+
+func newTransferStatus(destination backupservice.Destination, transferError string) job.TransferStatus {
+	return job.TransferStatus{
+		Destination:    destination.Name,
+		BackupService:  destination.BackupService.Name(),
+		BackupLocation: destination.BackupService.BackupLocation(),
+		Error:          transferError,
+	}
+}
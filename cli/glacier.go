@@ -0,0 +1,260 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+	"github.com/mleonard87/frosty/history"
+	"github.com/mleonard87/frosty/job"
+)
+
+const (
+	// The archive is in the inventory and matches what was recorded when it was uploaded.
+	INVENTORY_STATUS_OK = "ok"
+	// The archive is in the inventory but its tree hash is not the one recorded when it was uploaded.
+	INVENTORY_STATUS_CHECKSUM_MISMATCH = "checksum-mismatch"
+	// The archive was recorded as uploaded before the inventory was taken but is not in it.
+	INVENTORY_STATUS_MISSING = "missing"
+	// The archive was uploaded after the inventory was taken so can't be checked yet.
+	INVENTORY_STATUS_PENDING = "pending"
+	// The archive is in the inventory but there is no record of it being uploaded.
+	INVENTORY_STATUS_UNRECORDED = "unrecorded"
+)
+
+// An archive in a Glacier vault, as recorded in the history catalog and/or listed in the vault's inventory.
+type inventoryEntry struct {
+	Destination  string    `json:"destination"`
+	Vault        string    `json:"vault"`
+	ArchiveId    string    `json:"archiveId"`
+	Status       string    `json:"status"`
+	RunId        string    `json:"runId,omitempty"`
+	JobName      string    `json:"jobName,omitempty"`
+	Description  string    `json:"description"`
+	CreationDate time.Time `json:"creationDate"`
+	Size         int64     `json:"size"`
+	TreeHash     string    `json:"treeHash"`
+}
+
+// The result of retrieving a vault's inventory.
+type vaultInventory struct {
+	Destination   string
+	Vault         string
+	InventoryDate time.Time
+	Archives      []backupservice.GlacierInventoryArchive
+	Error         error
+}
+
+// Retrieve the inventory of Glacier vaults and reconcile it against the uploads recorded in the history catalog. This
+// exits with a non-zero status if any recorded upload is missing from its vault or has the wrong tree hash.
+func glacierInventory(configPath string, destinationName string, vaultName string, output string) {
+	fc, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	err = checkOutputFormat(output)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	var glacierDestinations []backupservice.Destination
+	for _, d := range backupservice.NewDestinations(fc) {
+		if d.BackupService.Name() != config.BACKUP_SERVICE_AMAZON_GLACIER {
+			continue
+		}
+		if destinationName != "" && d.Name != destinationName {
+			continue
+		}
+		glacierDestinations = append(glacierDestinations, d)
+	}
+
+	if len(glacierDestinations) == 0 {
+		log.Fatal("No Glacier backup destinations found in config file.")
+		os.Exit(1)
+	}
+
+	// Recorded uploads by destination, vault and archive ID. Archives frosty has since deleted are not included.
+	uploads := make(map[string]map[string]map[string]history.StoredArchive)
+	for _, d := range glacierDestinations {
+		archives, err := history.ListStoredArchives(job.GetWorkDirectoryPath(fc), d.Name)
+		if err != nil {
+			log.Fatalf("Error reading the history catalog: %s\n", err)
+			os.Exit(1)
+		}
+
+		uploads[d.Name] = make(map[string]map[string]history.StoredArchive)
+		for _, a := range archives {
+			if uploads[d.Name][a.Transfer.Container] == nil {
+				uploads[d.Name][a.Transfer.Container] = make(map[string]history.StoredArchive)
+			}
+			uploads[d.Name][a.Transfer.Container][a.Transfer.Key] = a
+		}
+	}
+
+	ch := make(chan vaultInventory)
+	var wg sync.WaitGroup
+
+	// Inventory retrieval jobs for each vault are run at the same time rather than waiting hours for each in turn.
+	for _, d := range glacierDestinations {
+		agss := d.BackupService.(*backupservice.AmazonGlacierBackupService)
+
+		for _, vn := range getInventoryVaultNames(agss, uploads[d.Name], vaultName) {
+			wg.Add(1)
+			go func(destinationName string, vaultName string) {
+				defer wg.Done()
+
+				log.Printf("Retrieving the inventory of Glacier vault %s, this usually takes 3-5 hours.\n", vaultName)
+				inventoryDate, archives, err := agss.RetrieveInventory(context.Background(), vaultName)
+				ch <- vaultInventory{
+					Destination:   destinationName,
+					Vault:         vaultName,
+					InventoryDate: inventoryDate,
+					Archives:      archives,
+					Error:         err,
+				}
+			}(d.Name, vn)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	var entries []inventoryEntry
+	failed := false
+
+	for vi := range ch {
+		if vi.Error != nil {
+			log.Printf("Unable to retrieve the inventory of Glacier vault %s: %s\n", vi.Vault, vi.Error)
+			failed = true
+			continue
+		}
+
+		for _, e := range reconcileInventory(vi, uploads[vi.Destination][vi.Vault]) {
+			if e.Status == INVENTORY_STATUS_MISSING || e.Status == INVENTORY_STATUS_CHECKSUM_MISMATCH {
+				failed = true
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, k int) bool {
+		return entries[i].CreationDate.After(entries[k].CreationDate)
+	})
+
+	if output == OUTPUT_FORMAT_JSON {
+		printJSON(entries)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DESTINATION\tVAULT\tSTATUS\tJOB\tCREATED\tSIZE\tARCHIVE ID")
+		for _, e := range entries {
+			jobName := e.JobName
+			if jobName == "" {
+				jobName = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+				e.Destination,
+				e.Vault,
+				e.Status,
+				jobName,
+				e.CreationDate.Local().Format(TABLE_TIME_FORMAT),
+				e.Size,
+				e.ArchiveId)
+		}
+		w.Flush()
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Get the vaults to retrieve the inventory of for a destination. This is the given vault if there is one, otherwise
+// the destination's configured vault along with every vault uploads have been recorded in.
+func getInventoryVaultNames(agss *backupservice.AmazonGlacierBackupService, uploads map[string]map[string]history.StoredArchive, vaultName string) []string {
+	if vaultName != "" {
+		return []string{vaultName}
+	}
+
+	vaultNames := []string{agss.VaultName}
+	for vn := range uploads {
+		if vn != agss.VaultName {
+			vaultNames = append(vaultNames, vn)
+		}
+	}
+	sort.Strings(vaultNames[1:])
+
+	return vaultNames
+}
+
+// Compare the archives in a vault's inventory with the uploads recorded for that vault.
+func reconcileInventory(vi vaultInventory, uploads map[string]history.StoredArchive) []inventoryEntry {
+	var entries []inventoryEntry
+	seen := make(map[string]bool)
+
+	for _, a := range vi.Archives {
+		e := inventoryEntry{
+			Destination:  vi.Destination,
+			Vault:        vi.Vault,
+			ArchiveId:    a.ArchiveId,
+			Status:       INVENTORY_STATUS_UNRECORDED,
+			Description:  a.ArchiveDescription,
+			CreationDate: a.CreationDate,
+			Size:         a.Size,
+			TreeHash:     a.SHA256TreeHash,
+		}
+
+		if u, ok := uploads[a.ArchiveId]; ok {
+			seen[a.ArchiveId] = true
+			e.RunId = u.RunId
+			e.JobName = u.JobName
+			e.Status = INVENTORY_STATUS_OK
+
+			// Uploads recorded before tree hashes were recorded can't be checked.
+			if u.Transfer.Checksum != "" && u.Transfer.Checksum != a.SHA256TreeHash {
+				e.Status = INVENTORY_STATUS_CHECKSUM_MISMATCH
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	for archiveId, u := range uploads {
+		if seen[archiveId] {
+			continue
+		}
+
+		e := inventoryEntry{
+			Destination:  vi.Destination,
+			Vault:        vi.Vault,
+			ArchiveId:    archiveId,
+			Status:       INVENTORY_STATUS_MISSING,
+			RunId:        u.RunId,
+			JobName:      u.JobName,
+			Description:  u.Transfer.Description,
+			CreationDate: u.Transfer.EndTime,
+			Size:         u.Size,
+			TreeHash:     u.Transfer.Checksum,
+		}
+
+		// Glacier only updates inventories about once a day so recent uploads will not be in it yet.
+		if u.Transfer.EndTime.After(vi.InventoryDate) {
+			e.Status = INVENTORY_STATUS_PENDING
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
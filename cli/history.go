@@ -0,0 +1,292 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+	"github.com/mleonard87/frosty/history"
+	"github.com/mleonard87/frosty/job"
+)
+
+const (
+	OUTPUT_FORMAT_TABLE = "table"
+	OUTPUT_FORMAT_JSON  = "json"
+	// The format times are shown in within tables.
+	TABLE_TIME_FORMAT = "2006-01-02 15:04:05"
+)
+
+// A job from a past run as shown by the history command.
+type historyEntry struct {
+	RunId    string `json:"runId"`
+	Hostname string `json:"hostname"`
+	history.JobRecord
+	// Shown by name rather than the number it is recorded as.
+	Status string `json:"status"`
+}
+
+// An archive as shown by the list-archives command.
+type archiveEntry struct {
+	Destination   string    `json:"destination"`
+	BackupService string    `json:"backupService"`
+	Hostname      string    `json:"hostname"`
+	JobName       string    `json:"jobName"`
+	FileName      string    `json:"fileName"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Size          int64     `json:"size"`
+	Container     string    `json:"container"`
+	Key           string    `json:"key"`
+}
+
+// Print the jobs recorded in the history catalog, newest first.
+func showHistory(configPath string, jobNames []string, since string, failedOnly bool, output string) {
+	fc, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	err = checkOutputFormat(output)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	var sinceTime time.Time
+	if since != "" {
+		sinceTime, err = parseSince(since)
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}
+
+	runs, err := history.ListRuns(job.GetWorkDirectoryPath(fc))
+	if err != nil {
+		log.Fatalf("Error reading the history catalog: %s\n", err)
+		os.Exit(1)
+	}
+
+	var entries []historyEntry
+
+	for i := len(runs) - 1; i >= 0; i-- {
+		for _, jr := range runs[i].Jobs {
+			if len(jobNames) > 0 && !containsString(jobNames, jr.Name) {
+				continue
+			}
+			if jr.StartTime.Before(sinceTime) {
+				continue
+			}
+			if failedOnly && jr.IsSuccessful() {
+				continue
+			}
+
+			entries = append(entries, historyEntry{
+				RunId:     runs[i].RunId,
+				Hostname:  runs[i].Hostname,
+				JobRecord: jr,
+				Status:    getStatusName(jr.Status),
+			})
+		}
+	}
+
+	if output == OUTPUT_FORMAT_JSON {
+		printJSON(entries)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN ID\tJOB\tSTATUS\tSTARTED\tDURATION\tARCHIVE\tSIZE\tDESTINATIONS")
+	for _, e := range entries {
+		archive, size := "-", "-"
+		if e.ArchiveName != "" {
+			archive = e.ArchiveName
+			size = fmt.Sprintf("%d", e.ArchiveSize)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.RunId,
+			e.Name,
+			e.Status,
+			e.StartTime.Local().Format(TABLE_TIME_FORMAT),
+			e.EndTime.Sub(e.StartTime).Round(time.Second),
+			archive,
+			size,
+			getTransfersDisplay(e.Transfers))
+	}
+	w.Flush()
+}
+
+// List the archives stored in the backup destinations for the given jobs (or all jobs if none are given), newest
+// first.
+func listArchives(configPath string, jobNames []string, destinationName string, hostname string, output string) {
+	fc, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	err = checkOutputFormat(output)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	jobs, err := selectJobs(fc.Jobs, jobNames)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if hostname == "" {
+		hostname, err = os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}
+
+	destinations := backupservice.NewDestinations(fc)
+	if destinationName != "" {
+		d, ok := backupservice.FindDestination(destinations, destinationName)
+		if !ok {
+			log.Fatalf("No backup destination named %q found in config file.", destinationName)
+			os.Exit(1)
+		}
+		destinations = []backupservice.Destination{d}
+	}
+
+	var entries []archiveEntry
+
+	var selectedJobNames []string
+	for _, j := range jobs {
+		selectedJobNames = append(selectedJobNames, j.Name)
+	}
+
+	for _, d := range destinations {
+		archives, err := findArchives(d, job.GetWorkDirectoryPath(fc), hostname, selectedJobNames)
+		if err != nil {
+			log.Fatalf("Error listing archives in %q: %s\n", d.Name, err)
+			os.Exit(1)
+		}
+
+		for _, a := range archives {
+			entries = append(entries, archiveEntry{
+				Destination:   d.Name,
+				BackupService: d.BackupService.Name(),
+				Hostname:      a.Hostname,
+				JobName:       a.JobName,
+				FileName:      a.FileName,
+				CreatedAt:     a.CreatedAt,
+				Size:          a.Size,
+				Container:     a.Container,
+				Key:           a.Key,
+			})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, k int) bool {
+		return entries[i].CreatedAt.After(entries[k].CreatedAt)
+	})
+
+	if output == OUTPUT_FORMAT_JSON {
+		printJSON(entries)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DESTINATION\tJOB\tCREATED\tSIZE\tCONTAINER\tKEY")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			e.Destination,
+			e.JobName,
+			e.CreatedAt.Local().Format(TABLE_TIME_FORMAT),
+			e.Size,
+			e.Container,
+			e.Key)
+	}
+	w.Flush()
+}
+
+func checkOutputFormat(output string) error {
+	if output != OUTPUT_FORMAT_TABLE && output != OUTPUT_FORMAT_JSON {
+		return fmt.Errorf("Unknown output format %q, expected %q or %q.", output, OUTPUT_FORMAT_TABLE, OUTPUT_FORMAT_JSON)
+	}
+	return nil
+}
+
+// Print the value as indented JSON on stdout. Empty lists are printed as [] rather than null.
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	if string(data) == "null" {
+		data = []byte("[]")
+	}
+	fmt.Println(string(data))
+}
+
+// Parse the --since flag. This may be a timestamp in any of the formats accepted by restore, in which case a date on
+// its own means the start of that day, or a duration before now such as "72h".
+func parseSince(since string) (time.Time, error) {
+	d, err := time.ParseDuration(since)
+	if err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", since, time.Local)
+	if err == nil {
+		return t, nil
+	}
+
+	return parseTimestamp(since)
+}
+
+func getStatusName(status int) string {
+	switch status {
+	case job.STATUS_SUCCESS:
+		return "success"
+	case job.STATUS_TIMEOUT:
+		return "timeout"
+	case job.STATUS_INTERRUPTED:
+		return "interrupted"
+	default:
+		return "failure"
+	}
+}
+
+// Get a summary of where a job's archive was transferred to for display in a table, e.g. "s3:host/job/... (failed)".
+func getTransfersDisplay(transfers []history.TransferRecord) string {
+	if len(transfers) == 0 {
+		return "-"
+	}
+
+	var parts []string
+	for _, tr := range transfers {
+		if tr.IsSuccessful() {
+			parts = append(parts, fmt.Sprintf("%s:%s", tr.Destination, tr.Key))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s (failed)", tr.Destination))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
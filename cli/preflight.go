@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+	"github.com/mleonard87/frosty/job"
+	"github.com/mleonard87/frosty/reporting"
+)
+
+const (
+	CHECK_PASSED = "PASS"
+	CHECK_FAILED = "FAIL"
+)
+
+// The outcome of one of the checks made by a deep validation.
+type checkResult struct {
+	Name   string
+	Status string
+	// What was found if the check passed, or why it failed.
+	Detail string
+}
+
+// Check that everything a valid config relies on is in place without running any jobs, sending any email or storing
+// any archives: each job's command can be found and executed, the work directory can be written to, the SMTP server
+// accepts the credentials and each destination can be reached with its credentials. The result of each check is
+// printed and false is returned if any failed.
+func preflight(fc config.FrostyConfig) bool {
+	var results []checkResult
+
+	for _, jc := range fc.Jobs {
+		detail, err := job.CheckCommand(jc)
+		results = append(results, newCheckResult(fmt.Sprintf("Job %q command", jc.Name), detail, err))
+	}
+
+	detail, err := backupservice.CheckDirectoryWritable(job.GetWorkDirectoryPath(fc))
+	results = append(results, newCheckResult("Work directory", detail, err))
+
+	if fc.ReportingConfig.Email.IsEnabled() {
+		detail, err := reporting.CheckEmail(&fc.ReportingConfig.Email)
+		results = append(results, newCheckResult("SMTP server", detail, err))
+	}
+
+	for _, d := range backupservice.NewDestinations(fc) {
+		detail, err := d.BackupService.Check()
+		results = append(results, newCheckResult(fmt.Sprintf("Destination %q (%s)", d.Name, d.BackupService.Name()), detail, err))
+	}
+
+	passed := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, r := range results {
+		// Errors from the checks may include secrets, e.g. in a URL.
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Status, r.Name, config.Redact(r.Detail))
+		if r.Status == CHECK_FAILED {
+			passed = false
+		}
+	}
+	w.Flush()
+
+	return passed
+}
+
+func newCheckResult(name string, detail string, err error) checkResult {
+	if err != nil {
+		return checkResult{
+			Name:   name,
+			Status: CHECK_FAILED,
+			Detail: err.Error(),
+		}
+	}
+
+	return checkResult{
+		Name:   name,
+		Status: CHECK_PASSED,
+		Detail: detail,
+	}
+}
@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+	"github.com/mleonard87/frosty/prune"
+)
+
+// What happened to an archive during pruning, as shown by the prune command.
+type pruneEntry struct {
+	Destination string    `json:"destination"`
+	JobName     string    `json:"jobName"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Container   string    `json:"container"`
+	Key         string    `json:"key"`
+	Action      string    `json:"action"`
+	Reason      string    `json:"reason"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Delete archives stored on this host that are older than their retention period, or only show what would be
+// deleted if dryRun is set. This exits with a non-zero status if anything could not be pruned.
+func pruneArchives(configPath string, jobNames []string, destinationName string, dryRun bool, output string) {
+	fc, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	err = checkOutputFormat(output)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	jobs, err := selectJobs(fc.Jobs, jobNames)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	destinations := backupservice.NewDestinations(fc)
+	if destinationName != "" {
+		d, ok := backupservice.FindDestination(destinations, destinationName)
+		if !ok {
+			log.Fatalf("No backup destination named %q found in config file.", destinationName)
+			os.Exit(1)
+		}
+		destinations = []backupservice.Destination{d}
+	}
+
+	decisions, pruneErr := prune.Prune(context.Background(), destinations, jobs, fc, dryRun)
+
+	var entries []pruneEntry
+	for _, d := range decisions {
+		entries = append(entries, pruneEntry{
+			Destination: d.Destination,
+			JobName:     d.Archive.JobName,
+			CreatedAt:   d.Archive.CreatedAt,
+			Container:   d.Archive.Container,
+			Key:         d.Archive.Key,
+			Action:      getPruneAction(d, dryRun),
+			Reason:      d.Reason,
+			Error:       d.Error,
+		})
+	}
+
+	if output == OUTPUT_FORMAT_JSON {
+		printJSON(entries)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DESTINATION\tJOB\tCREATED\tACTION\tKEY\tREASON")
+		for _, e := range entries {
+			reason := e.Reason
+			if e.Error != "" {
+				reason = e.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.Destination,
+				e.JobName,
+				e.CreatedAt.Local().Format(TABLE_TIME_FORMAT),
+				e.Action,
+				e.Key,
+				reason)
+		}
+		w.Flush()
+	}
+
+	if pruneErr != nil {
+		log.Fatal(pruneErr)
+		os.Exit(1)
+	}
+}
+
+func getPruneAction(d prune.Decision, dryRun bool) string {
+	switch {
+	case !d.Delete:
+		return "keep"
+	case d.Error != "":
+		return "failed"
+	case dryRun:
+		return "would delete"
+	default:
+		return "deleted"
+	}
+}
@@ -0,0 +1,231 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mleonard87/frosty/artifact"
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+	"github.com/mleonard87/frosty/history"
+	"github.com/mleonard87/frosty/job"
+)
+
+// The formats accepted for the --at flag, the first being the same as the ID given to each run of jobs.
+var timestampLayouts = []string{
+	"20060102150405",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Restore an archive previously stored for a job. The newest archive stored at or before the given time (or the
+// newest archive if no time is given) is retrieved from the backup service and extracted into the target directory.
+func restore(configPath string, jobName string, destinationName string, hostname string, at string, targetDir string) {
+	fc, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	err = restoreArchive(fc, jobName, destinationName, hostname, at, targetDir)
+	if err != nil {
+		log.Fatalf("Error restoring %q: %s\n", jobName, err)
+		os.Exit(1)
+	}
+}
+
+func restoreArchive(fc config.FrostyConfig, jobName string, destinationName string, hostname string, at string, targetDir string) error {
+	if jobName == "" || targetDir == "" {
+		return errors.New("both --job and --to must be given to restore an archive")
+	}
+
+	if hostname == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		hostname = h
+	}
+
+	var atTime time.Time
+	if at != "" {
+		t, err := parseTimestamp(at)
+		if err != nil {
+			return err
+		}
+		atTime = t
+	}
+
+	d, err := selectDestination(backupservice.NewDestinations(fc), destinationName)
+	if err != nil {
+		return err
+	}
+	bs := d.BackupService
+
+	log.Printf("Finding archives for %q on host %q\n", jobName, hostname)
+	archives, err := findArchives(d, job.GetWorkDirectoryPath(fc), hostname, []string{jobName})
+	if err != nil {
+		return err
+	}
+
+	a, ok := latestArchive(archives, atTime)
+
+	// The run history may not go back as far as the archive wanted, e.g. if it was created after the archive was stored.
+	if !ok && len(archives) > 0 && bs.Name() == config.BACKUP_SERVICE_AMAZON_GLACIER {
+		log.Printf("No archive stored at or before %s is recorded in the run history, retrieving the inventory of %q which usually takes 3-5 hours.\n", atTime.Format("02-Jan-2006 15:04:05"), d.Name)
+		archives, err = bs.ListArchives(context.Background(), hostname, jobName)
+		if err != nil {
+			return err
+		}
+		a, ok = latestArchive(archives, atTime)
+	}
+
+	if !ok {
+		return fmt.Errorf("no archive found for job %q on host %q", jobName, hostname)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "frosty-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	log.Printf("Retrieving %s stored at %s\n", a.FileName, a.CreatedAt.Format("02-Jan-2006 15:04:05"))
+	archivePath := filepath.Join(tmpDir, a.FileName)
+	err = bs.RetrieveFile(context.Background(), a, archivePath)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(archivePath, "."+job.ENCRYPTED_FILENAME_EXTENSION) {
+		decryptedPath := strings.TrimSuffix(archivePath, "."+job.ENCRYPTED_FILENAME_EXTENSION)
+		err = artifact.DecryptArtifactArchive(archivePath, decryptedPath, fc.Encryption)
+		if err != nil {
+			return err
+		}
+		archivePath = decryptedPath
+	}
+
+	err = artifact.ExtractArtifactArchive(archivePath, targetDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s to %s\n", a.FileName, targetDir)
+
+	return nil
+}
+
+// Get the named destination. The name may be left empty if there is only one destination.
+func selectDestination(destinations []backupservice.Destination, destinationName string) (backupservice.Destination, error) {
+	if destinationName == "" {
+		if len(destinations) != 1 {
+			return backupservice.Destination{}, errors.New("--destination must be given when there is more than one backup destination")
+		}
+		return destinations[0], nil
+	}
+
+	d, ok := backupservice.FindDestination(destinations, destinationName)
+	if !ok {
+		return backupservice.Destination{}, fmt.Errorf("no backup destination named %q found in config file", destinationName)
+	}
+
+	return d, nil
+}
+
+// Find the archives stored in a destination for the given jobs on a host. Glacier archives are looked up in the run
+// history as listing a vault means waiting 3-5 hours for an inventory that is up to a day out of date, so the most
+// recent archives would never be found. The inventory is only retrieved for jobs that have no archives from the host
+// in the run history, e.g. as they were stored by another host, and then only once for all of those jobs.
+func findArchives(d backupservice.Destination, workDir string, hostname string, jobNames []string) ([]backupservice.Archive, error) {
+	var archives []backupservice.Archive
+
+	if d.BackupService.Name() != config.BACKUP_SERVICE_AMAZON_GLACIER {
+		for _, jobName := range jobNames {
+			jobArchives, err := d.BackupService.ListArchives(context.Background(), hostname, jobName)
+			if err != nil {
+				return nil, err
+			}
+			archives = append(archives, jobArchives...)
+		}
+		return archives, nil
+	}
+
+	unrecorded := make(map[string]bool)
+	for _, jobName := range jobNames {
+		jobArchives, err := history.ListJobArchives(workDir, d.Name, hostname, jobName)
+		if err != nil {
+			return nil, err
+		}
+		if len(jobArchives) == 0 {
+			unrecorded[jobName] = true
+		}
+		archives = append(archives, jobArchives...)
+	}
+
+	if len(unrecorded) == 0 {
+		return archives, nil
+	}
+
+	// A single inventory of each vault lists the archives of every job.
+	jobName := ""
+	if len(jobNames) == 1 {
+		jobName = jobNames[0]
+	}
+
+	log.Printf("Not every job's archives on host %q are recorded in the run history, retrieving the inventory of %q which usually takes 3-5 hours.\n", hostname, d.Name)
+	inventory, err := d.BackupService.ListArchives(context.Background(), hostname, jobName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range inventory {
+		if unrecorded[a.JobName] {
+			archives = append(archives, a)
+		}
+	}
+
+	return archives, nil
+}
+
+// Get the newest archive created at or before the given time. If the time is zero then the newest archive overall
+// is returned.
+func latestArchive(archives []backupservice.Archive, at time.Time) (backupservice.Archive, bool) {
+	var latest backupservice.Archive
+	found := false
+
+	for _, a := range archives {
+		if !at.IsZero() && a.CreatedAt.After(at) {
+			continue
+		}
+		if !found || a.CreatedAt.After(latest.CreatedAt) {
+			latest = a
+			found = true
+		}
+	}
+
+	return latest, found
+}
+
+func parseTimestamp(timestamp string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		t, err := time.ParseInLocation(layout, timestamp, time.Local)
+		if err == nil {
+			// A date on its own means any time during that day.
+			if len(timestamp) == len("2006-01-02") {
+				t = t.Add(24*time.Hour - time.Second)
+			}
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unable to parse timestamp %q, expected a format such as %q", timestamp, timestampLayouts[0])
+}
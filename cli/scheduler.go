@@ -0,0 +1,235 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// Runs jobs on their schedules in the long-running backup mode. Each schedule has a single cron entry that runs the
+// jobs due at that time in the current config, so the config can be replaced while frosty is running. Batches that
+// have already started keep the config they started with, as it is passed to everything they do rather than read from
+// the config in use. When frosty is stopped running batches are given a grace period to finish before they are
+// interrupted.
+type scheduler struct {
+	sync.Mutex
+	cron       *cron.Cron
+	configPath string
+	fc         config.FrostyConfig
+	ds         []backupservice.Destination
+	// The jobs due at each schedule in the current config.
+	scheduledJobs map[string][]config.JobConfig
+	// The cron entry for each schedule.
+	entries map[string]cron.EntryID
+	// Cancelled to interrupt running batches once the shutdown grace period has passed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The batches that are running. No more are started once stopping is set.
+	running  sync.WaitGroup
+	stopping bool
+}
+
+func newScheduler(configPath string) *scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &scheduler{
+		cron:       cron.New(),
+		configPath: configPath,
+		entries:    make(map[string]cron.EntryID),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start running jobs on their schedules.
+func (s *scheduler) start() {
+	s.cron.Start()
+}
+
+// Read the config file again and use it for batches started from now on. If the config is not valid, or changes
+// something that cannot be changed while frosty is running, the current config is kept.
+func (s *scheduler) reload() {
+	log.Printf("Reloading frosty config file: %s\n", s.configPath)
+
+	fc, err := config.ReadConfig(s.configPath)
+	if ve, ok := err.(*config.ValidationError); ok {
+		for _, p := range ve.Problems {
+			log.Println(p)
+		}
+		log.Printf("Frosty config file: %v - FAILED with %d problem(s), keeping the current config\n", s.configPath, len(ve.Problems))
+		return
+	} else if err != nil {
+		log.Printf("%s\nKeeping the current config\n", err)
+		return
+	}
+
+	err = s.update(fc)
+	if err != nil {
+		log.Printf("%s\nKeeping the current config\n", err)
+		return
+	}
+
+	log.Printf("Frosty config file: %v - reloaded\n", s.configPath)
+}
+
+// Make fc the config in use, adding cron entries for schedules that are new and removing those for schedules that no
+// longer have any jobs. Entries for schedules that are in both configs are kept as they are so that interval schedules
+// such as "@every 6h" are not restarted. Nothing is changed if any of the schedules cannot be parsed.
+func (s *scheduler) update(fc config.FrostyConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sj := fc.ScheduledJobs()
+
+	added := make(map[string]cron.Schedule)
+	for k := range sj {
+		if _, ok := s.entries[k]; ok {
+			continue
+		}
+
+		schedule, err := cron.Parse(k)
+		if err != nil {
+			return fmt.Errorf("Error scheduling jobs: %s", err.Error())
+		}
+		added[k] = schedule
+	}
+
+	for k, id := range s.entries {
+		if _, ok := sj[k]; !ok {
+			s.cron.Remove(id)
+			delete(s.entries, k)
+		}
+	}
+
+	for k, schedule := range added {
+		// Assign k to spec to use in the closure below. If we used "k" in the function then every entry would run
+		// the jobs of the last schedule as the value of "k" is updated in each iteration of the loop.
+		spec := k
+		s.entries[k] = s.cron.Schedule(schedule, cron.FuncJob(func() {
+			s.runSchedule(spec)
+		}))
+	}
+
+	if s.scheduledJobs != nil {
+		logJobChanges(s.fc.Jobs, fc.Jobs)
+
+		// The secrets of the first config were redacted when it was loaded. Those of the config being replaced are
+		// still redacted until the batches that started with it have finished.
+		fc.UseSecrets()
+		s.fc.ReleaseSecrets()
+	}
+
+	s.fc = fc
+	s.ds = backupservice.NewDestinations(fc)
+	s.scheduledJobs = sj
+
+	return nil
+}
+
+// Stop starting batches and wait for those that are running to finish. If they have not finished once the grace period
+// in the current config has passed, or another signal is received on stop, the jobs still running are interrupted and
+// the batches are waited for again so that they are reported and their run directories are removed.
+func (s *scheduler) shutdown(stop <-chan os.Signal) {
+	s.Lock()
+	s.stopping = true
+	gracePeriod := s.fc.GetShutdownGracePeriod()
+	s.Unlock()
+
+	s.cron.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	default:
+	}
+
+	log.Printf("Waiting up to %s for running jobs to finish\n", gracePeriod)
+
+	select {
+	case <-done:
+		return
+	case <-time.After(gracePeriod):
+		log.Printf("Running jobs did not finish within %s, interrupting them\n", gracePeriod)
+	case sig := <-stop:
+		log.Printf("Received %s, interrupting running jobs\n", sig)
+	}
+
+	s.cancel()
+	<-done
+}
+
+// Run the batch of jobs due at the given schedule in the current config.
+func (s *scheduler) runSchedule(spec string) {
+	s.Lock()
+	if s.stopping {
+		s.Unlock()
+		return
+	}
+	jobs := s.scheduledJobs[spec]
+	ds := s.ds
+	fc := s.fc
+	// Added while locked so that shutdown cannot miss a batch that is about to start, and its config's secrets are
+	// used before a reload can release them.
+	s.running.Add(1)
+	fc.UseSecrets()
+	s.Unlock()
+
+	defer s.running.Done()
+	defer fc.ReleaseSecrets()
+
+	if len(jobs) == 0 {
+		return
+	}
+
+	runJobs(s.ctx, jobs, ds, fc)
+}
+
+// Log which jobs were added, removed or changed by a reload.
+func logJobChanges(previous []config.JobConfig, current []config.JobConfig) {
+	oldJobs := make(map[string]config.JobConfig)
+	for _, j := range previous {
+		oldJobs[j.Name] = j
+	}
+
+	var added, changed []string
+	for _, j := range current {
+		oj, ok := oldJobs[j.Name]
+		if !ok {
+			added = append(added, j.Name)
+		} else if !reflect.DeepEqual(oj, j) {
+			changed = append(changed, j.Name)
+		}
+		delete(oldJobs, j.Name)
+	}
+
+	var removed []string
+	for name := range oldJobs {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+
+	for _, name := range added {
+		log.Printf("Added job: %s\n", name)
+	}
+	for _, name := range changed {
+		log.Printf("Changed job: %s\n", name)
+	}
+	for _, name := range removed {
+		log.Printf("Removed job: %s\n", name)
+	}
+}
@@ -2,26 +2,112 @@ package config
 
 import (
 	"encoding/json"
-	"errors"
-	"io/ioutil"
-	"log"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/mleonard87/frosty/archivekey"
 )
 
 const (
 	BACKUP_SERVICE_AMAZON_GLACIER = "glacier"
 	BACKUP_SERVICE_AMAZON_S3      = "s3"
+	BACKUP_SERVICE_LOCAL          = "local"
+	ARCHIVE_FORMAT_ZIP            = "zip"
+	ARCHIVE_FORMAT_TAR_GZ         = "tar.gz"
+	ARCHIVE_FORMAT_TAR_ZST        = "tar.zst"
+)
+
+// How long to wait before the first retry if retries are configured without a backoff.
+const DEFAULT_RETRY_BACKOFF = 30 * time.Second
+
+// How long running jobs are given to finish when frosty is stopped if no grace period is configured.
+const DEFAULT_SHUTDOWN_GRACE_PERIOD = 5 * time.Minute
+
+// The compression levels that each archive format accepts. Zip and tar.gz both use deflate.
+const (
+	DEFLATE_MIN_COMPRESSION_LEVEL = 0
+	DEFLATE_MAX_COMPRESSION_LEVEL = 9
+	ZSTD_MIN_COMPRESSION_LEVEL    = 1
+	ZSTD_MAX_COMPRESSION_LEVEL    = 22
 )
 
-var frostyConfig FrostyConfig
+// The sizes in MB that S3 and Glacier accept for the parts of multipart uploads. Glacier also requires it to be a
+// power of two.
+const (
+	S3_MIN_PART_SIZE_MB      = 5
+	S3_MAX_PART_SIZE_MB      = 5120
+	GLACIER_MIN_PART_SIZE_MB = 1
+	GLACIER_MAX_PART_SIZE_MB = 4096
+)
+
+const (
+	S3_SSE_AES256 = "AES256"
+	S3_SSE_KMS    = "aws:kms"
+	// S3 allows 10 tags on an object, two of which are set by frosty.
+	S3_MAX_TAGS = 8
+)
+
+// The config in use. This is replaced when the config is reloaded while jobs may be running so it is guarded by a
+// lock.
+var frostyConfig struct {
+	sync.RWMutex
+	fc FrostyConfig
+}
+
+// The backup service types that may be used as keys in the frosty backup config.
+var backupServices = []string{
+	BACKUP_SERVICE_AMAZON_GLACIER,
+	BACKUP_SERVICE_AMAZON_S3,
+	BACKUP_SERVICE_LOCAL,
+}
+
+// The storage classes that archives may be stored in S3 with.
+var s3StorageClasses = []string{
+	"STANDARD",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"GLACIER_IR",
+	"DEEP_ARCHIVE",
+}
+
+// The formats that artifact archives may be created in.
+var archiveFormats = []string{
+	ARCHIVE_FORMAT_ZIP,
+	ARCHIVE_FORMAT_TAR_GZ,
+	ARCHIVE_FORMAT_TAR_ZST,
+}
 
 type FrostyConfig struct {
-	WorkDir         string                 `json:"workDirectory"`
-	ReportingConfig ReportingConfig        `json:"reporting"`
-	RawBackupConfig map[string]interface{} `json:"backup"`
-	BackupConfig    BackupConfig
-	Jobs            []JobConfig `json:"jobs"`
+	WorkDir         string          `json:"workDirectory"`
+	ReportingConfig ReportingConfig `json:"reporting"`
+	RawBackupConfig json.RawMessage `json:"backup"`
+	BackupConfigs   []BackupConfig
+	Encryption      EncryptionConfig `json:"encryption"`
+	ArchiveFormat   string           `json:"archiveFormat"`
+	// Nil if not set, in which case the default level for the archive format is used.
+	CompressionLevel *int `json:"compressionLevel"`
+	// The default for how long jobs may run before they are stopped, e.g. "2h". Empty if jobs may run indefinitely.
+	JobTimeout string `json:"jobTimeout"`
+	// How many times failed commands and transfers are retried, waiting for the backoff (e.g. "1m") before the first
+	// retry and doubling it for each one after that.
+	Retries      int    `json:"retries"`
+	RetryBackoff string `json:"retryBackoff"`
+	// How long running jobs are given to finish when frosty is stopped before they are interrupted, e.g. "10m".
+	ShutdownGracePeriod string `json:"shutdownGracePeriod"`
+	// The default retention policy for jobs. Nil if archives are only expired by age.
+	Retention *RetentionPolicy `json:"retention"`
+	// How archives are stored as objects in S3 destinations.
+	S3 S3ObjectConfig `json:"s3"`
+	// Patterns matching files whose jobs are added to those in this file, e.g. "jobs.d/*.yaml". Relative patterns
+	// are relative to the directory of this file.
+	Include []string    `json:"include"`
+	Jobs    []JobConfig `json:"jobs"`
+	// The values of the secret references in the config file. See UseSecrets.
+	secrets *resolvedSecrets
 }
 
 type ReportingConfig struct {
@@ -39,59 +125,567 @@ type EmailReportingConfig struct {
 	Recipients []string `json:"recipients"`
 }
 
+type EncryptionConfig struct {
+	Passphrase   string   `json:"passphrase"`
+	Recipients   []string `json:"recipients"`
+	IdentityFile string   `json:"identityFile"`
+}
+
+// How archives are stored as objects in S3. Empty fields use the bucket's defaults.
+type S3ObjectConfig struct {
+	StorageClass string `json:"storageClass"`
+	// Either "AES256" or "aws:kms", in which case the KMS key may be given. The bucket's default key is used if not.
+	ServerSideEncryption string            `json:"serverSideEncryption"`
+	KMSKeyId             string            `json:"kmsKeyId"`
+	Tags                 map[string]string `json:"tags"`
+}
+
+// A grandfather-father-son retention policy. Each rule keeps the newest archive from each of that many of the most
+// recent days, weeks, months or years that have archives, and keepLast keeps that many of the newest archives
+// regardless of when they were created. Archives not kept by any rule are deleted.
+type RetentionPolicy struct {
+	KeepLast    int `json:"keepLast"`
+	KeepDaily   int `json:"keepDaily"`
+	KeepWeekly  int `json:"keepWeekly"`
+	KeepMonthly int `json:"keepMonthly"`
+	KeepYearly  int `json:"keepYearly"`
+}
+
+// Whether the policy keeps no archives at all.
+func (rp RetentionPolicy) IsEmpty() bool {
+	return rp.KeepLast == 0 && rp.KeepDaily == 0 && rp.KeepWeekly == 0 && rp.KeepMonthly == 0 && rp.KeepYearly == 0
+}
+
+// Whether any email reporting settings are given. If not, no email reports are sent.
+func (erc EmailReportingConfig) IsEnabled() bool {
+	return erc.SMTP.Host != "" || erc.SMTP.Port != "" || erc.SMTP.Username != "" || erc.SMTP.Password != "" || erc.Sender != "" || len(erc.Recipients) > 0
+}
+
+// Whether archives should be encrypted before they are stored.
+func (ec EncryptionConfig) IsEnabled() bool {
+	return ec.Passphrase != "" || len(ec.Recipients) > 0
+}
+
 type JobConfig struct {
-	Name     string `json:"name"`
-	Command  string `json:"command"`
-	Schedule string `json:"schedule"`
+	Name         string   `json:"name"`
+	Command      string   `json:"command"`
+	Schedule     string   `json:"schedule"`
+	Destinations []string `json:"destinations"`
+	// Arguments passed to the command. In shell mode these are the shell's positional parameters ($1, $2...).
+	Args []string `json:"args"`
+	// Run the command through the system shell rather than executing it directly.
+	Shell bool `json:"shell"`
+	// The directory to run the command in. Empty to use frosty's own working directory.
+	WorkingDirectory string `json:"workingDirectory"`
+	// Extra environment variables to run the command with.
+	Env map[string]string `json:"env"`
+	// Overrides the retention period of each destination the job is stored in. Nil if not set.
+	RetentionDays *int64 `json:"retentionDays"`
+	// Overrides the global retention policy. Nil if not set.
+	Retention *RetentionPolicy `json:"retention"`
+	// Override the global archive settings. Empty or nil if not set.
+	ArchiveFormat    string `json:"archiveFormat"`
+	CompressionLevel *int   `json:"compressionLevel"`
+	// Overrides the global jobTimeout. Empty if not set.
+	Timeout string `json:"timeout"`
+	// Override the global retry settings. Nil or empty if not set.
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retryBackoff"`
+	// Overrides the global S3 object settings. Nil if not set.
+	S3 *S3ObjectConfig `json:"s3"`
+}
+
+// Get how long this job may run for before it is stopped, falling back to the given default if the job does not
+// override it. Returns 0 if the job may run indefinitely.
+func (jc JobConfig) GetTimeout(defaultTimeout string) time.Duration {
+	timeout := jc.Timeout
+	if timeout == "" {
+		timeout = defaultTimeout
+	}
+	if timeout == "" {
+		return 0
+	}
+
+	// Timeouts have already been checked when the config was validated.
+	d, _ := time.ParseDuration(timeout)
+	return d
+}
+
+// Get how many times this job's command and transfers should be retried if they fail, falling back to the given
+// default if the job does not override it.
+func (jc JobConfig) GetRetries(defaultRetries int) int {
+	if jc.Retries != nil {
+		return *jc.Retries
+	}
+	return defaultRetries
+}
+
+// Get how long to wait before the first retry of this job's command or transfers, falling back to the given default
+// if the job does not override it.
+func (jc JobConfig) GetRetryBackoff(defaultRetryBackoff string) time.Duration {
+	retryBackoff := jc.RetryBackoff
+	if retryBackoff == "" {
+		retryBackoff = defaultRetryBackoff
+	}
+	if retryBackoff == "" {
+		return DEFAULT_RETRY_BACKOFF
+	}
+
+	// Backoffs have already been checked when the config was validated.
+	d, _ := time.ParseDuration(retryBackoff)
+	return d
+}
+
+// Get the retention policy for this job's archives, falling back to the given default if the job does not override
+// it. Returns nil if the job's archives are only expired by age.
+func (jc JobConfig) GetRetentionPolicy(defaultRetention *RetentionPolicy) *RetentionPolicy {
+	if jc.Retention != nil {
+		return jc.Retention
+	}
+	return defaultRetention
+}
+
+// Get how this job's archives should be stored as S3 objects. Any settings the job has override the given defaults,
+// and its tags are added to the default tags.
+func (jc JobConfig) GetS3ObjectConfig(defaultS3 S3ObjectConfig) S3ObjectConfig {
+	if jc.S3 == nil {
+		return defaultS3
+	}
+
+	s3 := defaultS3
+	if jc.S3.StorageClass != "" {
+		s3.StorageClass = jc.S3.StorageClass
+	}
+	if jc.S3.ServerSideEncryption != "" {
+		s3.ServerSideEncryption = jc.S3.ServerSideEncryption
+		s3.KMSKeyId = jc.S3.KMSKeyId
+	}
+
+	s3.Tags = make(map[string]string)
+	for k, v := range defaultS3.Tags {
+		s3.Tags[k] = v
+	}
+	for k, v := range jc.S3.Tags {
+		s3.Tags[k] = v
+	}
+
+	return s3
+}
+
+// Whether archives from this job should be stored in the named destination. Jobs that do not list any destinations
+// are stored in all of them.
+func (jc JobConfig) UsesDestination(name string) bool {
+	if len(jc.Destinations) == 0 {
+		return true
+	}
+	for _, d := range jc.Destinations {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the number of days archives from this job should be kept for, falling back to the given default if the job
+// does not override it.
+func (jc JobConfig) GetRetentionDays(defaultRetentionDays int64) int64 {
+	if jc.RetentionDays != nil {
+		return *jc.RetentionDays
+	}
+	return defaultRetentionDays
 }
 
 type BackupConfig struct {
+	Name          string
 	BackupService string
 	BackupConfig  map[string]interface{}
+	// The JSON path of the destination's config, used to locate problems with it.
+	path string
 }
 
-func (fc *FrostyConfig) validateJobNames() bool {
-	ok := true
-	for _, j := range fc.Jobs {
-		jobNameCount := 0
-		for _, oj := range fc.Jobs {
-			if j.Name == oj.Name {
-				jobNameCount++
+func (fc *FrostyConfig) validateJobNames(v *validator) {
+	for i, j := range fc.Jobs {
+		for oi, oj := range fc.Jobs {
+			// Jobs may come from different files so say where the other job with the same name is.
+			if oi != i && j.Name == oj.Name {
+				v.addf(jobPath(i, "name"), "Job names must be unique - duplicate found for %q at %s.", j.Name, v.describeLocation(jobPath(oi, "name")))
+				break
 			}
 		}
-		if jobNameCount > 1 {
-			ok = false
-			log.Printf("Job names must be unique - duplicate found for %q.\n", j.Name)
-		}
 	}
-	return ok
 }
 
-func (fc *FrostyConfig) validateJobs() bool {
-	ok := true
+func (fc *FrostyConfig) validateJobs(v *validator) {
+	if len(fc.Jobs) == 0 {
+		v.addf("jobs", "At least one job must be configured.")
+	}
 	for i, j := range fc.Jobs {
 		if strings.TrimSpace(j.Name) == "" {
-			log.Printf("All jobs must have names and it must not be empty - job in position %d has no name.", i)
-			ok = false
+			v.addf(jobPath(i, "name"), "All jobs must have names and it must not be empty - job in position %d has no name.", i)
 		}
 		if strings.TrimSpace(j.Command) == "" {
-			log.Printf("All jobs must have a command and it must not be empty - %q has no command.", j.Name)
-			ok = false
+			v.addf(jobPath(i, "command"), "All jobs must have a command and it must not be empty - %q has no command.", j.Name)
+		}
+		validateSchedule(v, jobPath(i, "schedule"), j.Name, j.Schedule)
+		for k := range j.Env {
+			if k == "" || strings.ContainsAny(k, "=\x00") {
+				v.addf(jobPath(i, "env"), "Job environment variable names must not be empty or contain \"=\" - %q has %q.", j.Name, k)
+			}
+		}
+		for di, d := range j.Destinations {
+			if !fc.hasBackupConfig(d) {
+				v.addf(indexPath(jobPath(i, "destinations"), di), "Job destinations must be configured in the backup section - %q has unknown destination %q.", j.Name, d)
+			}
+		}
+		if !isValidArchiveFormat(j.ArchiveFormat) {
+			v.addf(jobPath(i, "archiveFormat"), "Archive formats must be one of %s - %q has %q.", strings.Join(archiveFormats, ", "), j.Name, j.ArchiveFormat)
+		} else {
+			fc.validateJobCompressionLevel(v, i, j)
+		}
+		if !isValidTimeout(j.Timeout) {
+			v.addf(jobPath(i, "timeout"), "Job timeouts must be a positive duration such as \"90m\" - %q has %q.", j.Name, j.Timeout)
+		}
+		if j.Retries != nil && *j.Retries < 0 {
+			v.addf(jobPath(i, "retries"), "Job retries must not be negative - %q has %d retries.", j.Name, *j.Retries)
+		}
+		if !isValidBackoff(j.RetryBackoff) {
+			v.addf(jobPath(i, "retryBackoff"), "Job retry backoffs must be a duration such as \"1m\" - %q has %q.", j.Name, j.RetryBackoff)
+		}
+		if j.Retention != nil && !isValidRetentionPolicy(*j.Retention) {
+			v.addf(jobPath(i, "retention"), "Job retention policies must keep at least one archive and not have negative counts - %q has %+v.", j.Name, *j.Retention)
+		}
+		if j.RetentionDays != nil && *j.RetentionDays < 0 {
+			v.addf(jobPath(i, "retentionDays"), "Job retention periods must not be negative - %q has %d retention days.", j.Name, *j.RetentionDays)
 		}
 	}
-	return ok
 }
 
-func (fc *FrostyConfig) validate() bool {
-	validationPassed := true
-	validationPassed = fc.validateJobNames()
-	validationPassed = fc.validateJobs()
+func (fc *FrostyConfig) hasBackupConfig(name string) bool {
+	for _, bc := range fc.BackupConfigs {
+		if bc.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
-	// TODO: Validate that if the email section is supplied then all the details are provided.
-	// TODO: Validate that the email addresses in the email section are actually email addresses.
-	// TODO: Validate that the schedules passed in are valid cron syntax.
+func (fc *FrostyConfig) validateBackupConfigs(v *validator) {
+	if len(fc.BackupConfigs) == 0 {
+		v.addf("backup", "At least one backup destination must be configured.")
+	}
+	for i, bc := range fc.BackupConfigs {
+		for _, obc := range fc.BackupConfigs[i+1:] {
+			if bc.Name == obc.Name {
+				v.addf(obc.path, "Backup destination names must be unique - duplicate found for %q.", bc.Name)
+			}
+		}
+		checkBackupSettings(v, bc)
+		bc.validateUploadOptions(v)
+		bc.validateKeyTemplate(v)
+		bc.validateAWSCredentials(v)
+	}
+}
 
-	return validationPassed
+// Check the credential settings of an S3 or Glacier destination. Keys are optional but must be given together, and
+// an external ID is only used when assuming a role.
+func (bc BackupConfig) validateAWSCredentials(v *validator) {
+	if bc.BackupService != BACKUP_SERVICE_AMAZON_S3 && bc.BackupService != BACKUP_SERVICE_AMAZON_GLACIER {
+		return
+	}
+	accessKeyId, _ := bc.BackupConfig["accessKeyId"].(string)
+	secretAccessKey, _ := bc.BackupConfig["secretAccessKey"].(string)
+	if (accessKeyId == "") != (secretAccessKey == "") {
+		v.addf(bc.path, "Both accessKeyId and secretAccessKey must be given for %q, or neither to use the default AWS credential chain.", bc.Name)
+	}
+	roleArn, _ := bc.BackupConfig["roleArn"].(string)
+	externalId, _ := bc.BackupConfig["externalId"].(string)
+	if externalId != "" && roleArn == "" {
+		v.addf(joinPath(bc.path, "externalId"), "An externalId is only used for %q if a roleArn is also given.", bc.Name)
+	}
+}
+
+// Get the template for the keys archives are stored under in this destination, made from the optional keyTemplate
+// and keyPrefix.
+func (bc BackupConfig) GetKeyTemplate() (*archivekey.Template, error) {
+	text, _ := bc.BackupConfig["keyTemplate"].(string)
+	prefix, _ := bc.BackupConfig["keyPrefix"].(string)
+	return archivekey.New(text, prefix)
+}
+
+// Check the key template of a destination. Settings that are not strings have already been reported.
+func (bc BackupConfig) validateKeyTemplate(v *validator) {
+	_, err := bc.GetKeyTemplate()
+	if err != nil {
+		v.addf(joinPath(bc.path, "keyTemplate"), "The key template for %q is not valid: %s", bc.Name, err)
+	}
+}
+
+// Check the multipart upload options of an S3 or Glacier destination, if they are set. Settings that are not numbers
+// have already been reported.
+func (bc BackupConfig) validateUploadOptions(v *validator) {
+	if partSizeMB, isNumber := bc.BackupConfig["partSizeMB"].(float64); isNumber && !isValidPartSize(bc.BackupService, partSizeMB) {
+		switch bc.BackupService {
+		case BACKUP_SERVICE_AMAZON_GLACIER:
+			v.addf(joinPath(bc.path, "partSizeMB"), "The part size for %q must be a power of two between %d and %d MB - found %v.", bc.Name, GLACIER_MIN_PART_SIZE_MB, GLACIER_MAX_PART_SIZE_MB, partSizeMB)
+		default:
+			v.addf(joinPath(bc.path, "partSizeMB"), "The part size for %q must be between %d and %d MB - found %v.", bc.Name, S3_MIN_PART_SIZE_MB, S3_MAX_PART_SIZE_MB, partSizeMB)
+		}
+	}
+	if concurrency, isNumber := bc.BackupConfig["uploadConcurrency"].(float64); isNumber && (concurrency < 1 || concurrency != float64(int(concurrency))) {
+		v.addf(joinPath(bc.path, "uploadConcurrency"), "The upload concurrency for %q must be a whole number of at least 1 - found %v.", bc.Name, concurrency)
+	}
+}
+
+func (fc *FrostyConfig) validateArchiveFormat(v *validator) {
+	if !isValidArchiveFormat(fc.ArchiveFormat) {
+		v.addf("archiveFormat", "The archive format must be one of %s - found %q.", strings.Join(archiveFormats, ", "), fc.ArchiveFormat)
+	}
+}
+
+func (fc *FrostyConfig) validateCompressionLevel(v *validator) {
+	if fc.CompressionLevel == nil || !isValidArchiveFormat(fc.ArchiveFormat) {
+		return
+	}
+
+	format := getArchiveFormat(fc.ArchiveFormat)
+	min, max := getCompressionLevels(format)
+	if *fc.CompressionLevel < min || *fc.CompressionLevel > max {
+		v.addf("compressionLevel", "The compression level for %q archives must be between %d and %d - found %d.", format, min, max, *fc.CompressionLevel)
+	}
+}
+
+// Check the compression level a job's artifacts are archived with against the format they are archived in. A job that
+// only overrides the format may make the global compression level invalid for it.
+func (fc *FrostyConfig) validateJobCompressionLevel(v *validator, i int, j JobConfig) {
+	format := j.ArchiveFormat
+	if format == "" {
+		format = fc.ArchiveFormat
+	}
+	format = getArchiveFormat(format)
+	min, max := getCompressionLevels(format)
+
+	if j.CompressionLevel != nil {
+		if *j.CompressionLevel < min || *j.CompressionLevel > max {
+			v.addf(jobPath(i, "compressionLevel"), "Job compression levels for %q archives must be between %d and %d - %q has %d.", format, min, max, j.Name, *j.CompressionLevel)
+		}
+		return
+	}
+
+	// Problems with the global level for the global format are reported against the global settings.
+	if j.ArchiveFormat != "" && fc.CompressionLevel != nil && (*fc.CompressionLevel < min || *fc.CompressionLevel > max) {
+		v.addf(jobPath(i, "archiveFormat"), "The global compression level of %d is not valid for %q archives, which must be between %d and %d - set a compressionLevel for %q.", *fc.CompressionLevel, format, min, max, j.Name)
+	}
+}
+
+func (fc *FrostyConfig) validateJobTimeout(v *validator) {
+	if !isValidTimeout(fc.JobTimeout) {
+		v.addf("jobTimeout", "The job timeout must be a positive duration such as \"90m\" - found %q.", fc.JobTimeout)
+	}
+}
+
+func (fc *FrostyConfig) validateRetries(v *validator) {
+	if fc.Retries < 0 {
+		v.addf("retries", "Retries must not be negative - found %d.", fc.Retries)
+	}
+	if !isValidBackoff(fc.RetryBackoff) {
+		v.addf("retryBackoff", "The retry backoff must be a duration such as \"1m\" - found %q.", fc.RetryBackoff)
+	}
+}
+
+func (fc *FrostyConfig) validateShutdownGracePeriod(v *validator) {
+	if !isValidBackoff(fc.ShutdownGracePeriod) {
+		v.addf("shutdownGracePeriod", "The shutdown grace period must be a duration such as \"10m\" - found %q.", fc.ShutdownGracePeriod)
+	}
+}
+
+func (fc *FrostyConfig) validateRetention(v *validator) {
+	if fc.Retention != nil && !isValidRetentionPolicy(*fc.Retention) {
+		v.addf("retention", "The retention policy must keep at least one archive and not have negative counts - found %+v.", *fc.Retention)
+	}
+}
+
+func (fc *FrostyConfig) validateS3(v *validator) {
+	validateS3ObjectConfig(v, "s3", fc.S3)
+	for i, jc := range fc.Jobs {
+		if jc.S3 == nil {
+			continue
+		}
+		validateS3ObjectConfig(v, jobPath(i, "s3"), *jc.S3)
+		// The job's tags are added to the global tags so there may be too many between them.
+		if tags := jc.GetS3ObjectConfig(fc.S3).Tags; len(tags) > S3_MAX_TAGS {
+			v.addf(jobPath(i, "s3.tags"), "At most %d tags may be set between the global and job %q s3 settings - found %d.", S3_MAX_TAGS, jc.Name, len(tags))
+		}
+	}
+}
+
+func (fc *FrostyConfig) validateEncryption(v *validator) {
+	if fc.Encryption.Passphrase != "" && len(fc.Encryption.Recipients) > 0 {
+		v.addf("encryption", "Archives may be encrypted with either a passphrase or recipients but not both.")
+	}
+}
+
+// Check the email reporting settings if any are given, in which case the SMTP server, sender and recipients are all
+// required.
+func (fc *FrostyConfig) validateEmail(v *validator) {
+	ec := fc.ReportingConfig.Email
+	if !ec.IsEnabled() {
+		return
+	}
+	if strings.TrimSpace(ec.SMTP.Host) == "" {
+		v.addf("reporting.email.smtp.host", "The SMTP host must be given to send email reports.")
+	}
+	if port, err := strconv.Atoi(ec.SMTP.Port); err != nil || port < 1 || port > 65535 {
+		v.addf("reporting.email.smtp.port", "The SMTP port must be a number between 1 and 65535 - found %q.", ec.SMTP.Port)
+	}
+	if ec.SMTP.Password != "" && ec.SMTP.Username == "" {
+		v.addf("reporting.email.smtp.password", "An SMTP password is only used if a username is also given.")
+	}
+	if ec.Sender == "" {
+		v.addf("reporting.email.sender", "The sender must be given to send email reports.")
+	} else {
+		validateEmailAddress(v, "reporting.email.sender", ec.Sender)
+	}
+	if len(ec.Recipients) == 0 {
+		v.addf("reporting.email.recipients", "At least one recipient must be given to send email reports.")
+	}
+	for i, r := range ec.Recipients {
+		validateEmailAddress(v, indexPath("reporting.email.recipients", i), r)
+	}
+}
+
+func (fc *FrostyConfig) validate(v *validator) {
+	fc.validateJobNames(v)
+	fc.validateJobs(v)
+	fc.validateBackupConfigs(v)
+	fc.validateEmail(v)
+	fc.validateEncryption(v)
+	fc.validateArchiveFormat(v)
+	fc.validateCompressionLevel(v)
+	fc.validateJobTimeout(v)
+	fc.validateRetries(v)
+	fc.validateShutdownGracePeriod(v)
+	fc.validateRetention(v)
+	fc.validateS3(v)
+}
+
+// Get the archive format to use for the configured format, which is zip if none is set.
+func getArchiveFormat(format string) string {
+	if format == "" {
+		return ARCHIVE_FORMAT_ZIP
+	}
+	return format
+}
+
+// Get the lowest and highest compression levels that an archive format accepts.
+func getCompressionLevels(format string) (int, int) {
+	if format == ARCHIVE_FORMAT_TAR_ZST {
+		return ZSTD_MIN_COMPRESSION_LEVEL, ZSTD_MAX_COMPRESSION_LEVEL
+	}
+	return DEFLATE_MIN_COMPRESSION_LEVEL, DEFLATE_MAX_COMPRESSION_LEVEL
+}
+
+// Whether the archive format is one that is supported. An empty format is valid as the default will be used.
+func isValidArchiveFormat(format string) bool {
+	if format == "" {
+		return true
+	}
+	for _, af := range archiveFormats {
+		if format == af {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the storage class is one that archives may be stored in S3 with. An empty storage class is valid as the
+// bucket's default will be used.
+func isValidStorageClass(storageClass string) bool {
+	if storageClass == "" {
+		return true
+	}
+	for _, sc := range s3StorageClasses {
+		if storageClass == sc {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the timeout is a positive duration. An empty timeout is valid as it means no timeout.
+func isValidTimeout(timeout string) bool {
+	if timeout == "" {
+		return true
+	}
+	d, err := time.ParseDuration(timeout)
+	return err == nil && d > 0
+}
+
+// Whether the retention policy keeps at least one archive. A policy that keeps nothing would delete every archive.
+func isValidRetentionPolicy(rp RetentionPolicy) bool {
+	if rp.KeepLast < 0 || rp.KeepDaily < 0 || rp.KeepWeekly < 0 || rp.KeepMonthly < 0 || rp.KeepYearly < 0 {
+		return false
+	}
+	return !rp.IsEmpty()
+}
+
+// Whether the part size is a whole number of MB that the backup service accepts for multipart uploads.
+func isValidPartSize(backupService string, partSizeMB float64) bool {
+	if partSizeMB != float64(int(partSizeMB)) {
+		return false
+	}
+	mb := int(partSizeMB)
+	switch backupService {
+	case BACKUP_SERVICE_AMAZON_S3:
+		return mb >= S3_MIN_PART_SIZE_MB && mb <= S3_MAX_PART_SIZE_MB
+	case BACKUP_SERVICE_AMAZON_GLACIER:
+		return mb >= GLACIER_MIN_PART_SIZE_MB && mb <= GLACIER_MAX_PART_SIZE_MB && mb&(mb-1) == 0
+	default:
+		return true
+	}
+}
+
+// Check the S3 object settings at path.
+func validateS3ObjectConfig(v *validator, path string, s3 S3ObjectConfig) {
+	if !isValidStorageClass(s3.StorageClass) {
+		v.addf(joinPath(path, "storageClass"), "The storage class must be one of %s - found %q.", strings.Join(s3StorageClasses, ", "), s3.StorageClass)
+	}
+	switch s3.ServerSideEncryption {
+	case "", S3_SSE_AES256:
+		if s3.KMSKeyId != "" {
+			v.addf(joinPath(path, "kmsKeyId"), "A KMS key may only be given if the server side encryption is %q.", S3_SSE_KMS)
+		}
+	case S3_SSE_KMS:
+	default:
+		v.addf(joinPath(path, "serverSideEncryption"), "The server side encryption must be %q or %q - found %q.", S3_SSE_AES256, S3_SSE_KMS, s3.ServerSideEncryption)
+	}
+	if len(s3.Tags) > S3_MAX_TAGS {
+		v.addf(joinPath(path, "tags"), "At most %d tags may be set - found %d.", S3_MAX_TAGS, len(s3.Tags))
+	}
+	for k, val := range s3.Tags {
+		if k == "" || len(k) > 128 || len(val) > 256 || strings.HasPrefix(k, "aws:") {
+			v.addf(joinPath(path, "tags"), "Tags must have a key of 1 to 128 characters not starting with \"aws:\" and a value of up to 256 characters - found %q=%q.", k, val)
+		}
+	}
+}
+
+// Whether the backoff is a duration that is not negative. An empty backoff is valid as the default will be used.
+func isValidBackoff(backoff string) bool {
+	if backoff == "" {
+		return true
+	}
+	d, err := time.ParseDuration(backoff)
+	return err == nil && d >= 0
+}
+
+// Get how long running jobs are given to finish when frosty is stopped before they are interrupted.
+func (fc *FrostyConfig) GetShutdownGracePeriod() time.Duration {
+	if fc.ShutdownGracePeriod == "" {
+		return DEFAULT_SHUTDOWN_GRACE_PERIOD
+	}
+
+	// The grace period has already been checked when the config was validated.
+	d, _ := time.ParseDuration(fc.ShutdownGracePeriod)
+	return d
 }
 
 func (fc *FrostyConfig) ScheduledJobs() map[string][]JobConfig {
@@ -112,43 +706,148 @@ func (fc *FrostyConfig) ScheduledJobs() map[string][]JobConfig {
 	return sj
 }
 
+// Load and validate a config file in any supported format along with the files it includes and make it the config in
+// use, redacting its secrets for as long as frosty runs. If it is not valid the error is a *ValidationError holding
+// every problem found.
 func LoadConfig(configPath string) (FrostyConfig, error) {
-	f, err := ioutil.ReadFile(configPath)
+	fc, err := ReadConfig(configPath)
 	if err != nil {
-		log.Fatalf("Cannot find frosty config file: %s\n", err)
-		os.Exit(1)
+		return fc, err
 	}
 
-	var fc FrostyConfig
-	err = json.Unmarshal(f, &fc)
-	if err != nil {
-		log.Fatalf("Cannot parse frosty config file: %v: %v Are you sure the JSON is valid?\n", configPath, err)
-		os.Exit(1)
-	}
+	SetFrostyConfig(fc)
+	fc.UseSecrets()
+
+	return fc, nil
+}
 
-	var backupConfig BackupConfig
-	if config, ok := fc.RawBackupConfig[BACKUP_SERVICE_AMAZON_GLACIER]; ok {
-		backupConfig.BackupService = BACKUP_SERVICE_AMAZON_GLACIER
-		backupConfig.BackupConfig = config.(map[string]interface{})
+// Read and validate a config file as LoadConfig does but without making it the config in use, e.g. so that a reloaded
+// config can be checked before it replaces the current one. Its secrets are not redacted until UseSecrets is called.
+func ReadConfig(configPath string) (FrostyConfig, error) {
+	fc, problems := parseConfig(configPath)
+	if len(problems) > 0 {
+		return fc, &ValidationError{
+			ConfigPath: configPath,
+			Problems:   problems,
+		}
 	}
 
-	if config, ok := fc.RawBackupConfig[BACKUP_SERVICE_AMAZON_S3]; ok {
-		backupConfig.BackupService = BACKUP_SERVICE_AMAZON_S3
-		backupConfig.BackupConfig = config.(map[string]interface{})
+	return fc, nil
+}
+
+// Make fc the config in use.
+func SetFrostyConfig(fc FrostyConfig) {
+	frostyConfig.Lock()
+	defer frostyConfig.Unlock()
+
+	frostyConfig.fc = fc
+}
+
+// Parse the "backup" config property into the destinations that archives are sent to. This is either a single object
+// keyed by backup service type, in which case each service is a destination named after its type, or a list of such
+// objects each with a "name" property. Destinations that cannot be parsed are recorded as problems and left out.
+func parseBackupConfigs(raw json.RawMessage, v *validator) []BackupConfig {
+	var backupConfigs []BackupConfig
+
+	if len(raw) > 0 && raw[0] == '[' {
+		var rawDestinations []map[string]interface{}
+		err := json.Unmarshal(raw, &rawDestinations)
+		if err != nil {
+			v.addf("backup", "The backup section must be an object or a list of objects.")
+			return nil
+		}
+
+		for i, rd := range rawDestinations {
+			path := indexPath("backup", i)
+			name, _ := rd["name"].(string)
+			if strings.TrimSpace(name) == "" {
+				v.addf(path, "Backup destination in position %d has no name.", i)
+				continue
+			}
+
+			var backupConfig *BackupConfig
+			for _, k := range sortedKeys(rd) {
+				if k == "name" {
+					continue
+				}
+				if !isBackupService(k) {
+					v.addf(joinPath(path, k), "Unknown setting %q for backup destination %q.", k, name)
+					continue
+				}
+				if backupConfig != nil {
+					v.addf(joinPath(path, k), "Backup destination %q must have exactly one backup service.", name)
+					continue
+				}
+				backupConfig = newBackupConfig(v, name, k, joinPath(path, k), rd[k])
+			}
+
+			if backupConfig == nil {
+				v.addf(path, "Backup destination %q must be one of %s.", name, strings.Join(backupServices, ", "))
+				continue
+			}
+
+			backupConfigs = append(backupConfigs, *backupConfig)
+		}
+	} else if len(raw) > 0 {
+		var rawServices map[string]interface{}
+		err := json.Unmarshal(raw, &rawServices)
+		if err != nil {
+			v.addf("backup", "The backup section must be an object or a list of objects.")
+			return nil
+		}
+
+		for _, k := range sortedKeys(rawServices) {
+			if !isBackupService(k) {
+				v.addf(joinPath("backup", k), "Unknown backup service %q - must be one of %s.", k, strings.Join(backupServices, ", "))
+			}
+		}
+
+		for _, bs := range backupServices {
+			if config, ok := rawServices[bs]; ok {
+				backupConfig := newBackupConfig(v, bs, bs, joinPath("backup", bs), config)
+				if backupConfig != nil {
+					backupConfigs = append(backupConfigs, *backupConfig)
+				}
+			}
+		}
 	}
 
-	fc.BackupConfig = backupConfig
+	return backupConfigs
+}
+
+// Create a destination from its raw config, recording a problem and returning nil if the config is not an object.
+func newBackupConfig(v *validator, name string, backupService string, path string, raw interface{}) *BackupConfig {
+	config, ok := raw.(map[string]interface{})
+	if !ok {
+		v.addf(path, "Backup destination %q has an invalid %q config - it must be an object.", name, backupService)
+		return nil
+	}
 
-	if !fc.validate() {
-		return fc, errors.New("Failed to validate config file: " + configPath)
+	return &BackupConfig{
+		Name:          name,
+		BackupService: backupService,
+		BackupConfig:  config,
+		path:          path,
 	}
+}
 
-	frostyConfig = fc
+func isBackupService(name string) bool {
+	for _, bs := range backupServices {
+		if name == bs {
+			return true
+		}
+	}
+	return false
+}
 
-	return fc, nil
+// Get the path of a setting of the job at position i.
+func jobPath(i int, key string) string {
+	return joinPath(indexPath("jobs", i), key)
 }
 
 func GetFrostConfig() FrostyConfig {
-	fc := frostyConfig
-	return fc
+	frostyConfig.RLock()
+	defer frostyConfig.RUnlock()
+
+	return frostyConfig.fc
 }
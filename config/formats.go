@@ -0,0 +1,305 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CONFIG_FORMAT_JSON = "JSON"
+	CONFIG_FORMAT_YAML = "YAML"
+	CONFIG_FORMAT_TOML = "TOML"
+)
+
+// An error parsing a config file, with the line it was found on if known.
+type parseError struct {
+	Line int
+	Err  error
+}
+
+func (pe *parseError) Error() string {
+	return pe.Err.Error()
+}
+
+// Get the format of a config file from its extension. Files without a YAML or TOML extension, such as the
+// conventional .frosty.config, are JSON.
+func getConfigFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return CONFIG_FORMAT_YAML
+	case ".toml":
+		return CONFIG_FORMAT_TOML
+	default:
+		return CONFIG_FORMAT_JSON
+	}
+}
+
+// Read a config file in any supported format, returning its values as they would be decoded from JSON along with
+// the line each is on, keyed by path. Lines are not known for TOML files.
+func readConfigFile(path string) (interface{}, map[string]int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read config file: %s", err)
+	}
+
+	format := getConfigFormat(path)
+
+	var raw interface{}
+	var lines map[string]int
+
+	switch format {
+	case CONFIG_FORMAT_YAML:
+		var doc yaml.Node
+		err = yaml.Unmarshal(data, &doc)
+		if err == nil {
+			err = doc.Decode(&raw)
+		}
+		if err != nil {
+			return nil, nil, &parseError{Err: fmt.Errorf("The config file is not valid %s: %s.", format, err)}
+		}
+		lines = make(map[string]int)
+		findYAMLLines(lines, "", &doc)
+	case CONFIG_FORMAT_TOML:
+		var table map[string]interface{}
+		_, err = toml.Decode(string(data), &table)
+		if err != nil {
+			var pe toml.ParseError
+			if errors.As(err, &pe) {
+				return nil, nil, &parseError{Line: pe.Position.Line, Err: fmt.Errorf("The config file is not valid %s: %s.", format, pe.Message)}
+			}
+			return nil, nil, &parseError{Err: fmt.Errorf("The config file is not valid %s: %s.", format, err)}
+		}
+		// Tables within arrays are decoded as typed slices so convert them to the values decoded from JSON.
+		data, err = json.Marshal(table)
+		if err == nil {
+			d := json.NewDecoder(bytes.NewReader(data))
+			d.UseNumber()
+			err = d.Decode(&raw)
+		}
+		if err != nil {
+			return nil, nil, &parseError{Err: fmt.Errorf("The config file could not be read: %s.", err)}
+		}
+	default:
+		d := json.NewDecoder(bytes.NewReader(data))
+		// Keep numbers as they were written as the config is encoded as JSON again once files are merged.
+		d.UseNumber()
+		err = d.Decode(&raw)
+		if se, ok := err.(*json.SyntaxError); ok {
+			// The offset is just after the character that could not be parsed.
+			return nil, nil, &parseError{Line: lineAt(data, se.Offset-1), Err: fmt.Errorf("The config file is not valid %s: %s.", format, se)}
+		} else if err != nil {
+			return nil, nil, &parseError{Err: fmt.Errorf("The config file is not valid %s: %s.", format, err)}
+		}
+		lines = findLines(data)
+	}
+
+	if _, ok := raw.(map[string]interface{}); !ok {
+		return nil, nil, &parseError{Line: 1, Err: fmt.Errorf("The config file must contain an object of settings.")}
+	}
+
+	return raw, lines, nil
+}
+
+// Add the jobs from each file matching the config's include patterns to its jobs so that jobs can be kept in separate
+// files, e.g. one for each team. Patterns are relative to the directory of the config file and included files may
+// only contain jobs. Values of the wrong type are left for decoding to report.
+func includeJobs(v *validator, configPath string, raw interface{}) {
+	config := raw.(map[string]interface{})
+
+	patterns, _ := config["include"].([]interface{})
+	if len(patterns) == 0 {
+		return
+	}
+
+	jobs, ok := config["jobs"].([]interface{})
+	if !ok && config["jobs"] != nil {
+		return
+	}
+
+	included := make(map[string]bool)
+	if abs, err := filepath.Abs(configPath); err == nil {
+		included[abs] = true
+	}
+
+	for pi, p := range patterns {
+		pattern, ok := p.(string)
+		if !ok {
+			continue
+		}
+		path := indexPath("include", pi)
+
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configPath), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			v.addf(path, "Include patterns must be valid file names or globs such as \"jobs.d/*.yaml\" - found %q: %s.", p, err)
+			continue
+		}
+		// A glob that matches nothing, e.g. an empty jobs.d directory, is fine but a file that is named outright must exist.
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			v.addf(path, "Included file %s does not exist.", pattern)
+		}
+
+		for _, match := range matches {
+			abs, err := filepath.Abs(match)
+			if err != nil {
+				v.addf(path, "Cannot include %s: %s.", match, err)
+				continue
+			}
+			if fi, err := os.Stat(match); included[abs] || (err == nil && fi.IsDir()) {
+				continue
+			}
+			included[abs] = true
+
+			jobs = append(jobs, readIncludedJobs(v, match, len(jobs))...)
+		}
+	}
+
+	config["jobs"] = jobs
+}
+
+// Read the jobs in an included file, recording where each came from so that problems with them are reported against
+// the file. The jobs are numbered from first in the merged config.
+func readIncludedJobs(v *validator, file string, first int) []interface{} {
+	raw, lines, err := readConfigFile(file)
+	if err != nil {
+		v.addFileError(file, err)
+		return nil
+	}
+
+	settings := raw.(map[string]interface{})
+	for _, k := range sortedKeys(settings) {
+		if k != "jobs" {
+			v.problems = append(v.problems, Problem{
+				File:    file,
+				Path:    k,
+				Line:    lineOf(lines, k),
+				Message: fmt.Sprintf("Unknown setting %q. Included files may only contain jobs.", k),
+			})
+		}
+	}
+
+	jobs, ok := settings["jobs"].([]interface{})
+	if !ok {
+		v.problems = append(v.problems, Problem{
+			File:    file,
+			Path:    "jobs",
+			Line:    lineOf(lines, "jobs"),
+			Message: "Included files must contain a list of jobs.",
+		})
+		return nil
+	}
+
+	for i := range jobs {
+		v.includedJobs = append(v.includedJobs, includedJob{
+			Path:     indexPath("jobs", first+i),
+			File:     file,
+			FilePath: indexPath("jobs", i),
+			lines:    lines,
+		})
+	}
+
+	return jobs
+}
+
+// Find the line that each value in a YAML document starts on, keyed by its path. The lines of mapping values are
+// those of their keys.
+func findYAMLLines(lines map[string]int, path string, node *yaml.Node) {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+
+	if _, ok := lines[path]; !ok {
+		lines[path] = node.Line
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			findYAMLLines(lines, path, n)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := joinPath(path, node.Content[i].Value)
+			lines[keyPath] = node.Content[i].Line
+			findYAMLLines(lines, keyPath, node.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			findYAMLLines(lines, indexPath(path, i), n)
+		}
+	}
+}
+
+// Find the line that each value in a JSON document starts on, keyed by its path. Values after a syntax error are
+// not included.
+func findLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		offset := d.InputOffset()
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		lines[path] = lineAt(data, offset)
+
+		switch t {
+		case json.Delim('{'):
+			for d.More() {
+				k, err := d.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := k.(string)
+				err = walk(joinPath(path, key))
+				if err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; d.More(); i++ {
+				err = walk(indexPath(path, i))
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+
+		// Read the closing delimiter.
+		_, err = d.Token()
+		return err
+	}
+
+	walk("")
+
+	return lines
+}
+
+// Get the line of the first token at or after an offset into a JSON document, skipping any whitespace and separators.
+func lineAt(data []byte, offset int64) int {
+	i := int(offset)
+	if i > len(data) {
+		i = len(data)
+	}
+	for i < len(data) && strings.IndexByte(" \t\r\n,:", data[i]) >= 0 {
+		i++
+	}
+	return bytes.Count(data[:i], []byte("\n")) + 1
+}
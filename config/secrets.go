@@ -0,0 +1,263 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SECRET_SOURCE_ENV  = "env"
+	SECRET_SOURCE_FILE = "file"
+	SECRET_SOURCE_CMD  = "cmd"
+	// What secrets are replaced with wherever they are redacted.
+	REDACTED = "[REDACTED]"
+	// Resolved values shorter than this are not redacted as doing so would hide too much unrelated text.
+	MIN_REDACTED_LENGTH = 4
+	// How long a command given as a secret reference may run for.
+	SECRET_COMMAND_TIMEOUT = 30 * time.Second
+)
+
+// Matches references to secrets such as ${env:SMTP_PASSWORD}, ${file:/run/secrets/aws_key} or
+// ${cmd:pass show frosty/s3}.
+var secretReferencePattern = regexp.MustCompile(`\$\{(env|file|cmd):([^}]*)\}`)
+
+// The values that the secret references in a config file have been resolved to.
+type resolvedSecrets struct {
+	values []string
+}
+
+// The secrets of the configs in use and how many users each config has. A config's secrets are redacted from the time
+// it is used until its last user releases it, so the secrets of a config that has been reloaded are still redacted from
+// the output of batches that started with it but not once they have finished.
+var secretsInUse struct {
+	sync.RWMutex
+	users map[*resolvedSecrets]int
+	// The secrets of every config in use, longest first so that a secret containing another is redacted whole.
+	values []string
+}
+
+// A writer that redacts resolved secrets from everything written to it.
+type redactingWriter struct {
+	w io.Writer
+}
+
+// Replace any references to secrets in the string values of the config file with the secrets themselves, recording a
+// problem for each that cannot be resolved. Every value a reference is resolved to is remembered by v so that it can be
+// redacted once the config is used.
+func resolveSecrets(data []byte, v *validator) []byte {
+	if !secretReferencePattern.Match(data) {
+		return data
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as they were written rather than converting them to floats and back.
+	d.UseNumber()
+
+	var raw interface{}
+	err := d.Decode(&raw)
+	if err != nil {
+		v.addf("", "The config file is not valid JSON: %s.", err)
+		return data
+	}
+
+	resolved, err := json.Marshal(resolveSecretReferences(v, "", raw))
+	if err != nil {
+		v.addf("", "The config file could not be read: %s.", err)
+		return data
+	}
+
+	return resolved
+}
+
+// Resolve the references in every string within the value at path.
+func resolveSecretReferences(v *validator, path string, value interface{}) interface{} {
+	switch val := value.(type) {
+	case string:
+		return resolveSecretString(v, path, val)
+	case map[string]interface{}:
+		for k, mv := range val {
+			val[k] = resolveSecretReferences(v, joinPath(path, k), mv)
+		}
+		return val
+	case []interface{}:
+		for i, lv := range val {
+			val[i] = resolveSecretReferences(v, indexPath(path, i), lv)
+		}
+		return val
+	default:
+		return value
+	}
+}
+
+// Replace each reference in the string with the secret it refers to.
+func resolveSecretString(v *validator, path string, s string) string {
+	return secretReferencePattern.ReplaceAllStringFunc(s, func(reference string) string {
+		match := secretReferencePattern.FindStringSubmatch(reference)
+
+		secret, err := resolveSecret(match[1], match[2])
+		if err != nil {
+			v.addf(path, "Unable to resolve secret %s: %s.", reference, err)
+			return ""
+		}
+
+		v.secrets.add(secret)
+		return secret
+	})
+}
+
+// Get a secret from its source. Trailing newlines are removed from secrets read from files and commands.
+func resolveSecret(source string, name string) (string, error) {
+	switch source {
+	case SECRET_SOURCE_ENV:
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("the environment variable %s is not set", name)
+		}
+		return value, nil
+	case SECRET_SOURCE_FILE:
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case SECRET_SOURCE_CMD:
+		ctx, cancel := context.WithTimeout(context.Background(), SECRET_COMMAND_TIMEOUT)
+		defer cancel()
+
+		cmd := secretCommand(ctx, name)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		output, err := cmd.Output()
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("the command did not finish within %s", SECRET_COMMAND_TIMEOUT)
+		}
+		if err != nil {
+			if stderr.Len() > 0 {
+				return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+	default:
+		return "", fmt.Errorf("unknown secret source %q", source)
+	}
+}
+
+// Remember a resolved secret so that it is redacted.
+func (rs *resolvedSecrets) add(secret string) {
+	if len(secret) < MIN_REDACTED_LENGTH || containsSecret(rs.values, secret) {
+		return
+	}
+
+	rs.values = append(rs.values, secret)
+}
+
+// Redact the secrets resolved from fc's config file until ReleaseSecrets has been called for it as many times as
+// UseSecrets. Anything that may log or report values from fc should use it for as long as it does so.
+func (fc FrostyConfig) UseSecrets() {
+	if fc.secrets == nil || len(fc.secrets.values) == 0 {
+		return
+	}
+
+	secretsInUse.Lock()
+	defer secretsInUse.Unlock()
+
+	if secretsInUse.users == nil {
+		secretsInUse.users = make(map[*resolvedSecrets]int)
+	}
+	secretsInUse.users[fc.secrets]++
+	updateSecretsInUse()
+}
+
+// Stop redacting the secrets resolved from fc's config file if nothing else is still using them.
+func (fc FrostyConfig) ReleaseSecrets() {
+	if fc.secrets == nil || len(fc.secrets.values) == 0 {
+		return
+	}
+
+	secretsInUse.Lock()
+	defer secretsInUse.Unlock()
+
+	if secretsInUse.users[fc.secrets] > 1 {
+		secretsInUse.users[fc.secrets]--
+		return
+	}
+	delete(secretsInUse.users, fc.secrets)
+	updateSecretsInUse()
+}
+
+// Gather the secrets of every config in use. Must be called with secretsInUse locked.
+func updateSecretsInUse() {
+	var values []string
+	for rs := range secretsInUse.users {
+		for _, v := range rs.values {
+			if !containsSecret(values, v) {
+				values = append(values, v)
+			}
+		}
+	}
+
+	secretsInUse.values = sortSecrets(values)
+}
+
+// Replace every secret resolved from a reference in the config files in use with REDACTED.
+func Redact(s string) string {
+	secretsInUse.RLock()
+	defer secretsInUse.RUnlock()
+
+	return redactSecrets(s, secretsInUse.values)
+}
+
+// Replace each of the secrets, which must be sorted longest first, with REDACTED.
+func redactSecrets(s string, secrets []string) string {
+	for _, v := range secrets {
+		s = strings.Replace(s, v, REDACTED, -1)
+	}
+
+	return s
+}
+
+// Sort secrets longest first so that a secret containing another is redacted whole.
+func sortSecrets(secrets []string) []string {
+	sort.SliceStable(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+
+	return secrets
+}
+
+func containsSecret(secrets []string, secret string) bool {
+	for _, v := range secrets {
+		if v == secret {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get a writer that redacts secrets from everything written to w, e.g. to use as the output of the log package.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w}
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(rw.w, Redact(string(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	// The caller's bytes have all been dealt with even if redaction changed how many were written.
+	return len(p), nil
+}
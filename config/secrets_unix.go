@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package config
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Build a command that runs a secret reference's command line through /bin/sh.
+func secretCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
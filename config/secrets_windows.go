@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package config
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Build a command that runs a secret reference's command line through cmd.exe.
+func secretCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd.exe", "/C", command)
+}
@@ -0,0 +1,582 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/robfig/cron.v2"
+)
+
+// The kinds of value that the settings of backup destinations may have.
+const (
+	SETTING_STRING = "a string"
+	SETTING_NUMBER = "a number"
+	SETTING_BOOL   = "true or false"
+)
+
+// A setting of a backup destination.
+type backupSetting struct {
+	Kind     string
+	Required bool
+}
+
+// The settings used to connect to AWS, which S3 and Glacier destinations share.
+var awsSettings = map[string]backupSetting{
+	"accessKeyId":     {Kind: SETTING_STRING},
+	"secretAccessKey": {Kind: SETTING_STRING},
+	"profile":         {Kind: SETTING_STRING},
+	"region":          {Kind: SETTING_STRING},
+	"roleArn":         {Kind: SETTING_STRING},
+	"externalId":      {Kind: SETTING_STRING},
+	"accountId":       {Kind: SETTING_STRING},
+}
+
+// The settings that destinations using each backup service may have.
+var backupServiceSettings = map[string]map[string]backupSetting{
+	BACKUP_SERVICE_AMAZON_S3: withSettings(awsSettings, map[string]backupSetting{
+		"bucketName":        {Kind: SETTING_STRING, Required: true},
+		"retentionDays":     {Kind: SETTING_NUMBER},
+		"endpoint":          {Kind: SETTING_STRING},
+		"pathStyleAccess":   {Kind: SETTING_BOOL},
+		"partSizeMB":        {Kind: SETTING_NUMBER},
+		"uploadConcurrency": {Kind: SETTING_NUMBER},
+		"keyTemplate":       {Kind: SETTING_STRING},
+		"keyPrefix":         {Kind: SETTING_STRING},
+	}),
+	BACKUP_SERVICE_AMAZON_GLACIER: withSettings(awsSettings, map[string]backupSetting{
+		"vaultName":          {Kind: SETTING_STRING},
+		"retentionDays":      {Kind: SETTING_NUMBER},
+		"allowEarlyDeletion": {Kind: SETTING_BOOL},
+		"partSizeMB":         {Kind: SETTING_NUMBER},
+		"uploadConcurrency":  {Kind: SETTING_NUMBER},
+		"keyTemplate":        {Kind: SETTING_STRING},
+		"keyPrefix":          {Kind: SETTING_STRING},
+	}),
+	BACKUP_SERVICE_LOCAL: {
+		"directory":     {Kind: SETTING_STRING, Required: true},
+		"retentionDays": {Kind: SETTING_NUMBER},
+		"keyTemplate":   {Kind: SETTING_STRING},
+		"keyPrefix":     {Kind: SETTING_STRING},
+	},
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// Matches the indexes in the paths of values that could not be decoded, e.g. the 0 in "jobs.0.retries".
+var fieldIndexPattern = regexp.MustCompile(`\.(\d+)`)
+
+// A problem found in a config file.
+type Problem struct {
+	// The included file the problem is in. Empty if it is in the main config file.
+	File string
+	// The JSON path of the value with the problem within its file, e.g. "jobs[2].schedule". Empty if it is not about
+	// a single value.
+	Path string
+	// The line of the file the value is on. 0 if it is not known.
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	var location []string
+	if p.File != "" {
+		location = append(location, p.File)
+	}
+	if p.Line > 0 {
+		location = append(location, fmt.Sprintf("line %d", p.Line))
+	}
+	if p.Path != "" {
+		location = append(location, p.Path)
+	}
+
+	if len(location) == 0 {
+		return p.Message
+	}
+	return strings.Join(location, ", ") + ": " + p.Message
+}
+
+// The error returned when a config file is not valid, holding every problem found in it.
+type ValidationError struct {
+	ConfigPath string
+	Problems   []Problem
+}
+
+func (ve *ValidationError) Error() string {
+	msg := fmt.Sprintf("Failed to validate config file: %s - %d problem(s) found:", ve.ConfigPath, len(ve.Problems))
+	for _, p := range ve.Problems {
+		msg += "\n\t" + p.String()
+	}
+	return msg
+}
+
+// A job merged into the config from an included file.
+type includedJob struct {
+	// The path of the job in the merged config, e.g. "jobs[4]".
+	Path string
+	File string
+	// The path of the job within the included file, e.g. "jobs[1]".
+	FilePath string
+	lines    map[string]int
+}
+
+// Collects the problems found while validating a config file, finding the file and line each is on from the JSON
+// path of the value it is about.
+type validator struct {
+	// The lines values are on in the main config file, keyed by path. Nil if they are not known.
+	lines        map[string]int
+	includedJobs []includedJob
+	problems     []Problem
+	// The secrets resolved from the config file, which are redacted from problems before the config is in use.
+	secrets resolvedSecrets
+}
+
+// Record a problem with the value at path. Secrets are redacted from the message as it may include the value.
+func (v *validator) addf(path string, format string, args ...interface{}) {
+	file, filePath, line := v.locate(path)
+
+	v.problems = append(v.problems, Problem{
+		File:    file,
+		Path:    filePath,
+		Line:    line,
+		Message: v.redact(fmt.Sprintf(format, args...)),
+	})
+}
+
+// Record a problem reading a file. Parse errors include the line they were found on.
+func (v *validator) addFileError(file string, err error) {
+	line := 0
+	if pe, ok := err.(*parseError); ok {
+		line = pe.Line
+	}
+
+	v.problems = append(v.problems, Problem{
+		File:    file,
+		Line:    line,
+		Message: v.redact(err.Error()),
+	})
+}
+
+// Redact the secrets resolved from the config file being validated as well as those of the configs in use.
+func (v *validator) redact(s string) string {
+	secretsInUse.RLock()
+	secrets := append([]string(nil), secretsInUse.values...)
+	secretsInUse.RUnlock()
+
+	for _, secret := range v.secrets.values {
+		if !containsSecret(secrets, secret) {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return redactSecrets(s, sortSecrets(secrets))
+}
+
+// Find which file the value at path in the merged config came from, its path within that file and the line it is
+// on.
+func (v *validator) locate(path string) (string, string, int) {
+	for _, ij := range v.includedJobs {
+		if path == ij.Path || strings.HasPrefix(path, ij.Path+".") || strings.HasPrefix(path, ij.Path+"[") {
+			filePath := ij.FilePath + path[len(ij.Path):]
+			return ij.File, filePath, lineOf(ij.lines, filePath)
+		}
+	}
+
+	return "", path, lineOf(v.lines, path)
+}
+
+// Describe where the value at path is, e.g. "jobs.d/team.yaml line 3", for problems that refer to another value.
+func (v *validator) describeLocation(path string) string {
+	file, filePath, line := v.locate(path)
+
+	location := filePath
+	if line > 0 {
+		location = fmt.Sprintf("line %d", line)
+	}
+	if file != "" {
+		location = file + " " + location
+	}
+	return location
+}
+
+// Get the problems found, in the order they appear in the config file followed by those in included files.
+func (v *validator) sortedProblems() []Problem {
+	problems := append([]Problem(nil), v.problems...)
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return problems[i].File < problems[j].File
+		}
+		return problems[i].Line < problems[j].Line
+	})
+	return problems
+}
+
+// Get the line the value at path is on. If the value is not in the file, e.g. a required setting that is missing, the
+// line of the closest value containing it is used instead.
+func lineOf(lines map[string]int, path string) int {
+	for path != "" {
+		if line, ok := lines[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+// Read and check a config file along with the files it includes, returning every problem found along with the config
+// itself, which is only complete if there were no problems.
+func parseConfig(configPath string) (FrostyConfig, []Problem) {
+	var fc FrostyConfig
+	v := &validator{}
+
+	raw, lines, err := readConfigFile(configPath)
+	if err != nil {
+		v.addFileError("", err)
+		return fc, v.sortedProblems()
+	}
+	v.lines = lines
+
+	includeJobs(v, configPath, raw)
+
+	// Every format is checked and decoded as JSON so that they are all mapped onto the config in the same way.
+	data, err := json.Marshal(raw)
+	if err != nil {
+		v.addf("", "The config file could not be read: %s.", err)
+		return fc, v.sortedProblems()
+	}
+
+	// Decoding stops at the first value of the wrong type so every value is checked against the config first.
+	found := len(v.problems)
+	checkSettings(v, "", raw, reflect.TypeOf(fc))
+	err = json.Unmarshal(data, &fc)
+	if te, ok := err.(*json.UnmarshalTypeError); ok && len(v.problems) == found {
+		v.addf(fieldIndexPattern.ReplaceAllString(te.Field, "[$1]"), "Must be %s - found %s.", describeType(te.Type), te.Value)
+	} else if err != nil && !ok {
+		v.addf("", "The config file could not be read: %s.", err)
+	}
+
+	// Settings whose secrets could not be resolved would otherwise be reported as empty, so stop if any are found.
+	found = len(v.problems)
+	data = resolveSecrets(data, v)
+	if len(v.problems) > found {
+		return fc, v.sortedProblems()
+	}
+
+	fc = FrostyConfig{}
+	// Values of the wrong type have already been reported and are left as their zero values.
+	json.Unmarshal(data, &fc)
+
+	fc.secrets = &v.secrets
+	fc.BackupConfigs = parseBackupConfigs(fc.RawBackupConfig, v)
+	fc.validate(v)
+
+	return fc, v.sortedProblems()
+}
+
+// Check the raw config against the type it is decoded into, reporting keys that do not match the JSON name of a field
+// and values of the wrong type. The backup section is checked when it is parsed.
+func checkSettings(v *validator, path string, raw interface{}, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// A null leaves the setting as its zero value whatever its type.
+	if raw == nil {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			v.addf(path, "Must be %s - found %s.", describeType(t), describeValue(raw))
+			return
+		}
+
+		fields := make(map[string]reflect.Type)
+		var names []string
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+				names = append(names, name)
+			}
+		}
+
+		for _, k := range sortedKeys(obj) {
+			ft, ok := fields[k]
+			if !ok {
+				v.addf(joinPath(path, k), "Unknown setting %q.%s", k, suggestKey(k, names))
+				continue
+			}
+			if ft != rawMessageType {
+				checkSettings(v, joinPath(path, k), obj[k], ft)
+			}
+		}
+	case reflect.Map:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			v.addf(path, "Must be %s - found %s.", describeType(t), describeValue(raw))
+			return
+		}
+		for _, k := range sortedKeys(obj) {
+			checkSettings(v, joinPath(path, k), obj[k], t.Elem())
+		}
+	case reflect.Slice:
+		list, ok := raw.([]interface{})
+		if !ok {
+			v.addf(path, "Must be %s - found %s.", describeType(t), describeValue(raw))
+			return
+		}
+		for i, item := range list {
+			checkSettings(v, indexPath(path, i), item, t.Elem())
+		}
+	case reflect.String:
+		if _, ok := raw.(string); !ok {
+			v.addf(path, "Must be %s - found %s.", describeType(t), describeValue(raw))
+		}
+	case reflect.Bool:
+		if _, ok := raw.(bool); !ok {
+			v.addf(path, "Must be %s - found %s.", describeType(t), describeValue(raw))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, ok := wholeNumber(raw); !ok {
+			v.addf(path, "Must be %s - found %s.", describeType(t), describeValue(raw))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := wholeNumber(raw); !ok || n < 0 {
+			v.addf(path, "Must be %s - found %s.", describeType(t), describeValue(raw))
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := number(raw); !ok {
+			v.addf(path, "Must be %s - found %s.", describeType(t), describeValue(raw))
+		}
+	}
+}
+
+// Get the value of a number read from any of the config formats. JSON and TOML numbers are read as json.Number while
+// YAML numbers are read as Go numbers.
+func number(raw interface{}) (float64, bool) {
+	switch n := raw.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// Get the value of a number read from any of the config formats if it is a whole number.
+func wholeNumber(raw interface{}) (int64, bool) {
+	if n, ok := raw.(json.Number); ok {
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	f, ok := number(raw)
+	if !ok || f != float64(int64(f)) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// Check the settings of a backup destination against those its backup service has, reporting unknown settings,
+// required settings that are missing and values of the wrong type.
+func checkBackupSettings(v *validator, bc BackupConfig) {
+	settings := backupServiceSettings[bc.BackupService]
+	var names []string
+	for k := range settings {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range sortedKeys(bc.BackupConfig) {
+		setting, ok := settings[k]
+		if !ok {
+			v.addf(joinPath(bc.path, k), "Unknown setting %q for %s destinations.%s", k, bc.BackupService, suggestKey(k, names))
+			continue
+		}
+
+		value := bc.BackupConfig[k]
+		var isKind bool
+		switch setting.Kind {
+		case SETTING_STRING:
+			_, isKind = value.(string)
+		case SETTING_NUMBER:
+			_, isKind = value.(float64)
+		case SETTING_BOOL:
+			_, isKind = value.(bool)
+		}
+		if !isKind {
+			v.addf(joinPath(bc.path, k), "Must be %s - found %s.", setting.Kind, describeValue(value))
+		}
+	}
+
+	for _, k := range names {
+		if !settings[k].Required {
+			continue
+		}
+		if s, ok := bc.BackupConfig[k].(string); !ok || strings.TrimSpace(s) == "" {
+			if _, found := bc.BackupConfig[k]; !found {
+				v.addf(bc.path, "The %q setting is required for %s destinations.", k, bc.BackupService)
+			} else if ok {
+				v.addf(joinPath(bc.path, k), "The %q setting must not be empty.", k)
+			}
+		}
+	}
+
+	if rd, ok := bc.BackupConfig["retentionDays"].(float64); ok && (rd < 0 || rd != float64(int64(rd))) {
+		v.addf(joinPath(bc.path, "retentionDays"), "The retention period for %q must be a whole number of days that is not negative - found %v.", bc.Name, rd)
+	}
+}
+
+// Check that a schedule can be parsed by the scheduler.
+func validateSchedule(v *validator, path string, jobName string, schedule string) {
+	if strings.TrimSpace(schedule) == "" {
+		v.addf(path, "All jobs must have a schedule and it must not be empty - %q has no schedule.", jobName)
+		return
+	}
+	_, err := parseSchedule(schedule)
+	if err != nil {
+		v.addf(path, "Job schedules must be cron syntax such as \"0 1 * * *\" or a descriptor such as \"@daily\" - %q has %q: %s.", jobName, schedule, err)
+	}
+}
+
+// Parse a schedule in the same way as the scheduler. cron.Parse logs the errors it returns as well as returning them, so
+// while it runs the log output is held back and then written out without the entry for the error. Entries logged by
+// anything else in the meantime, e.g. running jobs when the config is reloaded, are delayed rather than lost.
+func parseSchedule(schedule string) (cron.Schedule, error) {
+	held := &heldLog{}
+	w := log.Writer()
+	log.SetOutput(held)
+	s, err := cron.Parse(schedule)
+	log.SetOutput(w)
+
+	held.Lock()
+	defer held.Unlock()
+	for _, entry := range held.entries {
+		if err != nil && bytes.HasSuffix(entry, []byte(err.Error()+"\n")) {
+			continue
+		}
+		w.Write(entry)
+	}
+
+	return s, err
+}
+
+// Log output held back while a schedule is parsed. The logger writes each entry in a single call.
+type heldLog struct {
+	sync.Mutex
+	entries [][]byte
+}
+
+func (h *heldLog) Write(p []byte) (int, error) {
+	h.Lock()
+	defer h.Unlock()
+	h.entries = append(h.entries, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// Check that an email address, which may include a display name, can be parsed.
+func validateEmailAddress(v *validator, path string, address string) {
+	_, err := mail.ParseAddress(address)
+	if err != nil {
+		v.addf(path, "Email addresses must be valid such as \"frosty@example.com\" - found %q: %s.", address, err)
+	}
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+// Suggest the known key that an unknown key differs from only by case, as JSON keys are case sensitive in frosty's
+// checks but not when decoded.
+func suggestKey(key string, known []string) string {
+	for _, k := range known {
+		if strings.EqualFold(k, key) {
+			return fmt.Sprintf(" Did you mean %q?", k)
+		}
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func withSettings(maps ...map[string]backupSetting) map[string]backupSetting {
+	settings := make(map[string]backupSetting)
+	for _, m := range maps {
+		for k, v := range m {
+			settings[k] = v
+		}
+	}
+	return settings
+}
+
+// Describe the type of value a Go type is decoded from, e.g. "a whole number" for an int.
+func describeType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return SETTING_STRING
+	case reflect.Bool:
+		return SETTING_BOOL
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return SETTING_NUMBER
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	default:
+		return "an object"
+	}
+}
+
+// Describe a value decoded from JSON for a problem.
+func describeValue(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(val)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
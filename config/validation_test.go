@@ -0,0 +1,190 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		// The config file is the first file. Any others may be included by it.
+		files [][2]string
+		// Each problem as it is printed by validate.
+		want []string
+	}{
+		{
+			name: "valid",
+			files: [][2]string{{"frosty.yaml", `
+backup:
+  local:
+    directory: /var/backups/frosty
+jobs:
+  - name: postgres
+    command: /opt/backups/postgres.sh
+    schedule: "@daily"
+`}},
+		},
+		{
+			name: "wrong types and unknown settings",
+			files: [][2]string{{"frosty.yaml", `
+retries: three
+compressionLevel: 1.5
+backup:
+  local:
+    directory: /var/backups/frosty
+jobs:
+  - name: postgres
+    command: /opt/backups/postgres.sh
+    schedule: "@daily"
+    shell: "yes"
+    comand: /opt/backups/mysql.sh
+`}},
+			want: []string{
+				`line 2, retries: Must be a whole number - found "three".`,
+				`line 3, compressionLevel: Must be a whole number - found 1.5.`,
+				`line 11, jobs[0].shell: Must be true or false - found "yes".`,
+				`line 12, jobs[0].comand: Unknown setting "comand".`,
+			},
+		},
+		{
+			name: "schedules",
+			files: [][2]string{{"frosty.json", `{
+  "backup": {"local": {"directory": "/var/backups/frosty"}},
+  "jobs": [
+    {"name": "fields", "command": "true", "schedule": "1 2 3"},
+    {"name": "descriptor", "command": "true", "schedule": "@fortnightly"},
+    {"name": "empty", "command": "true", "schedule": ""}
+  ]
+}`}},
+			want: []string{
+				`line 4, jobs[0].schedule: Job schedules must be cron syntax such as "0 1 * * *" or a descriptor such as "@daily" - "fields" has "1 2 3": Expected 5 or 6 fields, found 3: 1 2 3.`,
+				`line 5, jobs[1].schedule: Job schedules must be cron syntax such as "0 1 * * *" or a descriptor such as "@daily" - "descriptor" has "@fortnightly": Unrecognized descriptor: @fortnightly.`,
+				`line 6, jobs[2].schedule: All jobs must have a schedule and it must not be empty - "empty" has no schedule.`,
+			},
+		},
+		{
+			name: "included jobs",
+			files: [][2]string{
+				{"frosty.yaml", `
+backup:
+  local:
+    directory: /var/backups/frosty
+include:
+  - jobs.d/*.toml
+jobs:
+  - name: postgres
+    command: /opt/backups/postgres.sh
+    schedule: "@daily"
+`},
+				{"jobs.d/databases.toml", `
+[[jobs]]
+name = "postgres"
+command = "/opt/backups/postgres.sh"
+schedule = "@daily"
+
+[[jobs]]
+name = "mysql"
+schedule = "@daily"
+`},
+			},
+			want: []string{
+				`line 8, jobs[0].name: Job names must be unique - duplicate found for "postgres" at <dir>/jobs.d/databases.toml jobs[0].name.`,
+				`<dir>/jobs.d/databases.toml, jobs[0].name: Job names must be unique - duplicate found for "postgres" at line 8.`,
+				`<dir>/jobs.d/databases.toml, jobs[1].command: All jobs must have a command and it must not be empty - "mysql" has no command.`,
+			},
+		},
+		{
+			name: "unresolved secret",
+			files: [][2]string{{"frosty.yaml", `
+reporting:
+  email:
+    smtp:
+      host: smtp.example.com
+      port: "587"
+      password: ${env:FROSTY_TEST_UNSET_SECRET}
+    sender: frosty@example.com
+    recipients:
+      - ops@example.com
+backup:
+  local:
+    directory: /var/backups/frosty
+jobs:
+  - name: postgres
+    command: /opt/backups/postgres.sh
+    schedule: "@daily"
+`}},
+			want: []string{
+				`line 7, reporting.email.smtp.password: Unable to resolve secret ${env:FROSTY_TEST_UNSET_SECRET}: the environment variable FROSTY_TEST_UNSET_SECRET is not set.`,
+			},
+		},
+		{
+			name: "redacted secret",
+			files: [][2]string{{"frosty.yaml", `
+backup:
+  local:
+    directory: /var/backups/frosty
+jobs:
+  - name: postgres
+    command: /opt/backups/postgres.sh
+    schedule: ${env:FROSTY_TEST_SECRET}
+`}},
+			want: []string{
+				`line 8, jobs[0].schedule: Job schedules must be cron syntax such as "0 1 * * *" or a descriptor such as "@daily" - "postgres" has "[REDACTED]": Expected 5 or 6 fields, found 1: [REDACTED].`,
+			},
+		},
+	}
+
+	os.Setenv("FROSTY_TEST_SECRET", "hunter2hunter2")
+	defer os.Unsetenv("FROSTY_TEST_SECRET")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "frosty-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			for _, f := range tt.files {
+				path := filepath.Join(dir, filepath.FromSlash(f[0]))
+				err = os.MkdirAll(filepath.Dir(path), 0755)
+				if err == nil {
+					err = ioutil.WriteFile(path, []byte(f[1]), 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Problems are only reported through the error, not logged.
+			var logged bytes.Buffer
+			w := log.Writer()
+			log.SetOutput(&logged)
+			_, err = ReadConfig(filepath.Join(dir, tt.files[0][0]))
+			log.SetOutput(w)
+
+			var got []string
+			if ve, ok := err.(*ValidationError); ok {
+				for _, p := range ve.Problems {
+					got = append(got, strings.Replace(filepath.ToSlash(p.String()), filepath.ToSlash(dir), "<dir>", -1))
+				}
+			} else if err != nil {
+				t.Fatalf("ReadConfig returned an error that is not a *ValidationError: %s", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Got problems:\n%q\nwant:\n%q", got, tt.want)
+			}
+			if logged.Len() > 0 {
+				t.Errorf("ReadConfig logged %q", logged.String())
+			}
+		})
+	}
+}
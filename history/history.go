@@ -0,0 +1,339 @@
+package history
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/job"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	HISTORY_DB_FILENAME = "history.db"
+	RUNS_BUCKET_NAME    = "runs"
+	// How long to wait for another frosty process to finish with the catalog before giving up.
+	HISTORY_DB_LOCK_TIMEOUT = 30 * time.Second
+)
+
+// A record of a single run of one or more jobs. Jobs on the same schedule are run together.
+type RunRecord struct {
+	RunId     string      `json:"runId"`
+	Hostname  string      `json:"hostname"`
+	StartTime time.Time   `json:"startTime"`
+	EndTime   time.Time   `json:"endTime"`
+	Jobs      []JobRecord `json:"jobs"`
+}
+
+// A record of how a job went during a run.
+type JobRecord struct {
+	Name      string    `json:"name"`
+	Status    int       `json:"status"`
+	StdOut    string    `json:"stdout"`
+	StdErr    string    `json:"stderr"`
+	Error     string    `json:"error"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Attempts  int       `json:"attempts"`
+	// The archive is only recorded if the job created one.
+	ArchiveName     string           `json:"archiveName"`
+	ArchiveSize     int64            `json:"archiveSize"`
+	ArchiveChecksum string           `json:"archiveChecksum"`
+	Transfers       []TransferRecord `json:"transfers"`
+}
+
+// A record of a job's archive being transferred to a backup destination.
+type TransferRecord struct {
+	Destination    string    `json:"destination"`
+	BackupService  string    `json:"backupService"`
+	BackupLocation string    `json:"backupLocation"`
+	Container      string    `json:"container"`
+	Key            string    `json:"key"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+	Error          string    `json:"error"`
+	Attempts       int       `json:"attempts"`
+	// Only recorded for Glacier archives.
+	Description string `json:"description,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	// When frosty deleted the archive from the destination. Nil if it has not been deleted.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// An archive recorded as stored in a destination by a job.
+type StoredArchive struct {
+	RunId    string
+	Hostname string
+	JobName  string
+	FileName string
+	Size     int64
+	Transfer TransferRecord
+}
+
+func (jr JobRecord) IsSuccessful() bool {
+	return jr.Status == job.STATUS_SUCCESS
+}
+
+func (tr TransferRecord) IsSuccessful() bool {
+	return tr.Error == ""
+}
+
+// Build a record of a run from the statuses of the jobs that were run.
+func NewRunRecord(runId string, startTime time.Time, endTime time.Time, jobStatuses []job.JobStatus) RunRecord {
+	hostname, _ := os.Hostname()
+
+	rr := RunRecord{
+		RunId:     runId,
+		Hostname:  hostname,
+		StartTime: startTime,
+		EndTime:   endTime,
+	}
+
+	for _, js := range jobStatuses {
+		jr := JobRecord{
+			Name:      js.JobConfig.Name,
+			Status:    js.Status,
+			StdOut:    js.StdOut,
+			StdErr:    js.StdErr,
+			Error:     js.Error,
+			StartTime: js.StartTime,
+			EndTime:   js.EndTime,
+			Attempts:  js.AttemptCount(),
+		}
+
+		if js.ArchiveCreated {
+			jr.ArchiveName = js.GetArchiveNameDisplay()
+			jr.ArchiveSize = js.ArchiveSize
+			jr.ArchiveChecksum = js.ArchiveChecksum
+		}
+
+		for _, ts := range js.Transfers {
+			jr.Transfers = append(jr.Transfers, TransferRecord{
+				Destination:    ts.Destination,
+				BackupService:  ts.BackupService,
+				BackupLocation: ts.BackupLocation,
+				Container:      ts.Container,
+				Key:            ts.Key,
+				Description:    ts.Description,
+				Checksum:       ts.Checksum,
+				StartTime:      ts.StartTime,
+				EndTime:        ts.EndTime,
+				Error:          ts.Error,
+				Attempts:       ts.AttemptCount(),
+			})
+		}
+
+		rr.Jobs = append(rr.Jobs, jr)
+	}
+
+	return rr
+}
+
+// Add a run to the catalog. Run IDs only have a resolution of one second so if jobs on different schedules started
+// at the same time and already have a record, this run's jobs are added to it.
+func RecordRun(workDir string, rr RunRecord) error {
+	db, err := openCatalog(workDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(RUNS_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+
+		if existing := b.Get([]byte(rr.RunId)); existing != nil {
+			var er RunRecord
+			err = json.Unmarshal(existing, &er)
+			if err != nil {
+				return err
+			}
+
+			rr.Jobs = append(er.Jobs, rr.Jobs...)
+			if er.StartTime.Before(rr.StartTime) {
+				rr.StartTime = er.StartTime
+			}
+			if er.EndTime.After(rr.EndTime) {
+				rr.EndTime = er.EndTime
+			}
+		}
+
+		data, err := json.Marshal(rr)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(rr.RunId), data)
+	})
+}
+
+// List every run in the catalog, oldest first.
+func ListRuns(workDir string) ([]RunRecord, error) {
+	db, err := openCatalog(workDir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var runs []RunRecord
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RUNS_BUCKET_NAME))
+		if b == nil {
+			return nil
+		}
+
+		// Run IDs are timestamps so the keys are already in the order the runs started.
+		return b.ForEach(func(k, v []byte) error {
+			var rr RunRecord
+			err := json.Unmarshal(v, &rr)
+			if err != nil {
+				return err
+			}
+			runs = append(runs, rr)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// List the archives recorded as stored in the named destination that have not since been deleted, oldest first.
+func ListStoredArchives(workDir string, destination string) ([]StoredArchive, error) {
+	runs, err := ListRuns(workDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []StoredArchive
+
+	for _, rr := range runs {
+		for _, jr := range rr.Jobs {
+			for _, tr := range jr.Transfers {
+				if tr.Destination != destination || !tr.IsSuccessful() || tr.DeletedAt != nil {
+					continue
+				}
+				archives = append(archives, StoredArchive{
+					RunId:    rr.RunId,
+					Hostname: rr.Hostname,
+					JobName:  jr.Name,
+					FileName: jr.ArchiveName,
+					Size:     jr.ArchiveSize,
+					Transfer: tr,
+				})
+			}
+		}
+	}
+
+	return archives, nil
+}
+
+// List the archives recorded as stored in a destination by a job on a host, as they would be listed by the
+// destination's backup service. This is used to find Glacier archives without waiting hours for an inventory of the
+// vault.
+func ListJobArchives(workDir string, destination string, hostname string, jobName string) ([]backupservice.Archive, error) {
+	stored, err := ListStoredArchives(workDir, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []backupservice.Archive
+
+	for _, sa := range stored {
+		if sa.Hostname != hostname || sa.JobName != jobName {
+			continue
+		}
+
+		archives = append(archives, backupservice.Archive{
+			Hostname:    sa.Hostname,
+			JobName:     sa.JobName,
+			FileName:    sa.FileName,
+			CreatedAt:   sa.Transfer.StartTime,
+			Size:        sa.Size,
+			Container:   sa.Transfer.Container,
+			Key:         sa.Transfer.Key,
+			Description: sa.Transfer.Description,
+			Checksum:    sa.Transfer.Checksum,
+		})
+	}
+
+	return archives, nil
+}
+
+// Record that an archive was deleted from a destination so that it is no longer listed as stored there.
+func MarkArchiveDeleted(workDir string, destination string, container string, key string, deletedAt time.Time) error {
+	db, err := openCatalog(workDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RUNS_BUCKET_NAME))
+		if b == nil {
+			return nil
+		}
+
+		updated := make(map[string][]byte)
+
+		err := b.ForEach(func(k, v []byte) error {
+			var rr RunRecord
+			err := json.Unmarshal(v, &rr)
+			if err != nil {
+				return err
+			}
+
+			found := false
+			for i := range rr.Jobs {
+				for j := range rr.Jobs[i].Transfers {
+					tr := &rr.Jobs[i].Transfers[j]
+					if tr.Destination == destination && tr.Container == container && tr.Key == key {
+						tr.DeletedAt = &deletedAt
+						found = true
+					}
+				}
+			}
+
+			if found {
+				data, err := json.Marshal(rr)
+				if err != nil {
+					return err
+				}
+				updated[string(k)] = data
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Buckets must not be modified while iterating over them so the updated runs are stored afterwards.
+		for k, data := range updated {
+			err = b.Put([]byte(k), data)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Open the catalog in the work directory, creating it if it does not already exist. Only one process may have the
+// catalog open at a time so it should be closed as soon as possible.
+func openCatalog(workDir string) (*bolt.DB, error) {
+	err := os.MkdirAll(workDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return bolt.Open(filepath.Join(workDir, HISTORY_DB_FILENAME), 0600, &bolt.Options{Timeout: HISTORY_DB_LOCK_TIMEOUT})
+}
@@ -1,6 +1,11 @@
 package job
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -8,6 +13,7 @@ import (
 	"os/exec"
 
 	"os"
+	"path/filepath"
 
 	"fmt"
 
@@ -18,40 +24,136 @@ import (
 const (
 	STATUS_SUCCESS = iota
 	STATUS_FAILURE = iota
-	BYTES_PER_SI   = 1000
+	STATUS_TIMEOUT = iota
+	// The job was stopped before it finished as frosty was shutting down.
+	STATUS_INTERRUPTED = iota
+	BYTES_PER_SI       = 1000
+	// How long a job's processes are given to exit after being asked to before they are killed.
+	JOB_TERMINATION_GRACE_PERIOD = 30 * time.Second
+	// How long to keep reading a command's output after it has exited. Processes it left running in the background
+	// may hold its stdout and stderr open indefinitely, so they are closed after this.
+	JOB_OUTPUT_WAIT_DELAY = 10 * time.Second
 )
 
 var BINARY_SI_UNITS = [...]string{"B", " kB", " MB", " GB", " TB", " PB", " EB", " ZB"}
 
+// AWS credentials in frosty's own environment are only for storing archives so they are removed from the environment
+// job commands are run with. Jobs that need them must set them in their env.
+var SCRUBBED_ENVIRONMENT_VARIABLES = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_ACCESS_KEY",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SECRET_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_SECURITY_TOKEN",
+	"AWS_WEB_IDENTITY_TOKEN_FILE",
+	"AWS_ROLE_ARN",
+	"AWS_ROLE_SESSION_NAME",
+	"AWS_PROFILE",
+	"AWS_DEFAULT_PROFILE",
+	"AWS_CONFIG_FILE",
+	"AWS_SHARED_CREDENTIALS_FILE",
+}
+
 type JobStatus struct {
-	Status            int
-	StdOut            string
-	StdErr            string
-	Error             string
-	StartTime         time.Time
-	EndTime           time.Time
-	JobConfig         config.JobConfig
-	ArchiveCreated    bool
-	ArchiveSize       int64
-	TransferStartTime time.Time
-	TransferEndTime   time.Time
-	TransferError     string
+	Status         int
+	StdOut         string
+	StdErr         string
+	Error          string
+	StartTime      time.Time
+	EndTime        time.Time
+	JobConfig      config.JobConfig
+	ArchiveCreated bool
+	// Where the archive was created, which is only set if it was.
+	ArchivePath string
+	ArchiveSize int64
+	// The hex encoded SHA-256 checksum of the archive.
+	ArchiveChecksum string
+	Transfers       []TransferStatus
+	// The attempts at running the command that failed before it was retried.
+	FailedAttempts []FailedAttempt
+}
+
+// An attempt at running a job's command or transferring its archive that failed and was then retried.
+type FailedAttempt struct {
+	StartTime time.Time
+	EndTime   time.Time
+	Error     string
+	StdErr    string
+}
+
+// The result of transferring a job's archive to a single backup destination.
+type TransferStatus struct {
+	Destination    string
+	BackupService  string
+	BackupLocation string
+	StartTime      time.Time
+	EndTime        time.Time
+	Error          string
+	// Where the destination stored the archive, e.g. the S3 bucket and object key or Glacier vault and archive ID.
+	Container string
+	Key       string
+	// The Glacier archive description and SHA-256 tree hash. Empty for other backup services.
+	Description string
+	Checksum    string
+	// The attempts at the transfer that failed before it was retried.
+	FailedAttempts []FailedAttempt
 }
 
 func (js JobStatus) ElapsedTime() time.Duration {
 	return js.EndTime.Sub(js.StartTime)
 }
 
-func (js JobStatus) ElapsedTransferTime() time.Duration {
-	return js.TransferEndTime.Sub(js.TransferStartTime)
+// Record the result of a transfer to a destination. Any failed transfer fails the job as a whole.
+func (js *JobStatus) AddTransfer(ts TransferStatus) {
+	if !ts.IsSuccessful() && js.IsSuccessful() {
+		js.Status = STATUS_FAILURE
+	}
+	js.Transfers = append(js.Transfers, ts)
+}
+
+// The number of times the job's command was run, including the final attempt.
+func (js JobStatus) AttemptCount() int {
+	return len(js.FailedAttempts) + 1
+}
+
+// The number of times the transfer was attempted, including the final attempt.
+func (ts TransferStatus) AttemptCount() int {
+	return len(ts.FailedAttempts) + 1
+}
+
+func (ts TransferStatus) ElapsedTime() time.Duration {
+	return ts.EndTime.Sub(ts.StartTime)
+}
+
+func (ts TransferStatus) IsSuccessful() bool {
+	return ts.Error == ""
+}
+
+// Whether the job's archive was transferred to at least one destination.
+func (js JobStatus) HasSuccessfulTransfer() bool {
+	for _, ts := range js.Transfers {
+		if ts.IsSuccessful() {
+			return true
+		}
+	}
+	return false
 }
 
 func (js JobStatus) IsSuccessful() bool {
 	return js.Status == STATUS_SUCCESS
 }
 
+func (js JobStatus) IsTimedOut() bool {
+	return js.Status == STATUS_TIMEOUT
+}
+
+func (js JobStatus) IsInterrupted() bool {
+	return js.Status == STATUS_INTERRUPTED
+}
+
 func (js JobStatus) GetArchiveNameDisplay() string {
-	return GetArtifactArchiveFileName(js.JobConfig.Name)
+	return filepath.Base(js.ArchivePath)
 }
 
 func (js JobStatus) GetArchiveSizeDisplay() string {
@@ -66,13 +168,18 @@ func (js JobStatus) GetArchiveSizeDisplay() string {
 	return strconv.FormatInt(js.ArchiveSize, 10) + BINARY_SI_UNITS[0]
 }
 
-func Start(jobConfig config.JobConfig, runId string) JobStatus {
+// Run the job's command and archive any artifacts it creates. If the command fails it is run again, with any
+// artifacts from the failed attempt removed, until it succeeds or the job's retries are used up. A command that times
+// out is retried too, as the timeout applies to each attempt. The command is stopped if the context is cancelled or
+// the job's timeout passes before it exits, and the job is interrupted if the context is cancelled. The job is run
+// with the given config throughout, even if another is loaded while it is running.
+func Start(ctx context.Context, jobConfig config.JobConfig, fc config.FrostyConfig, runId string) JobStatus {
 	js := JobStatus{}
 	js.JobConfig = jobConfig
 	js.Status = STATUS_SUCCESS
 	js.StartTime = time.Now()
 
-	jobDir, artifactDir, err := MakeJobDirectories(jobConfig.Name, runId)
+	jobDir, artifactDir, err := MakeJobDirectories(jobConfig.Name, fc, runId)
 	if err != nil {
 		js.Status = STATUS_FAILURE
 		js.Error = err.Error()
@@ -80,33 +187,49 @@ func Start(jobConfig config.JobConfig, runId string) JobStatus {
 		return js
 	}
 
-	env := os.Environ()
-	env = append(env, fmt.Sprintf("FROSTY_JOB_DIR=%s", jobDir))
-	env = append(env, fmt.Sprintf("FROSTY_JOB_ARTIFACTS_DIR=%s", artifactDir))
-	cmd := exec.Command(jobConfig.Command)
-	cmd.Env = env
+	retries, retryBackoff := GetRetryPolicy(jobConfig, fc)
 
-	out, err := cmd.Output()
-	if err != nil {
-		js.Status = STATUS_FAILURE
+	for attempt := 1; ; attempt++ {
+		attemptStartTime := time.Now()
+		js.Status, js.Error, js.StdOut, js.StdErr = runJobCommand(ctx, jobConfig, fc, jobDir, artifactDir)
+		js.EndTime = time.Now()
 
-		if ee, ok := err.(*exec.ExitError); ok {
-			// Capture and trim any errors logged to stderr.
-			js.StdErr = strings.TrimSpace(string(ee.Stderr))
+		if js.IsSuccessful() || attempt > retries || ctx.Err() != nil {
+			break
 		}
 
-		js.Error = err.Error()
-		js.EndTime = time.Now()
-		js.StdOut = strings.TrimSpace(string(out[:]))
+		js.FailedAttempts = append(js.FailedAttempts, FailedAttempt{
+			StartTime: attemptStartTime,
+			EndTime:   js.EndTime,
+			Error:     js.Error,
+			StdErr:    js.StdErr,
+		})
+		log.Printf("Attempt %d of job %s failed, retrying:\n%s\n", attempt, jobConfig.Name, js.Error)
 
-		return js
+		if !WaitForRetry(ctx, retryBackoff, attempt) {
+			js.Status = STATUS_INTERRUPTED
+			js.Error = "Job was stopped before it could be retried."
+			js.EndTime = time.Now()
+			break
+		}
+
+		// Start each attempt with an empty artifact directory so nothing from the failed attempt is archived.
+		err = resetArtifactDirectory(artifactDir)
+		if err != nil {
+			js.Status = STATUS_FAILURE
+			js.Error = err.Error()
+			js.EndTime = time.Now()
+			return js
+		}
 	}
 
-	js.EndTime = time.Now()
-	js.StdOut = strings.TrimSpace(string(out[:]))
+	if !js.IsSuccessful() {
+		return js
+	}
 
-	archiveTarget := GetArtifactArchiveTargetName(jobConfig.Name, runId)
-	js.ArchiveCreated, err = artifact.MakeArtifactArchive(artifactDir, archiveTarget)
+	archiveTarget := GetArtifactArchiveTargetName(jobConfig, fc, runId)
+	unencryptedArchiveTarget := getUnencryptedArtifactArchiveTargetName(jobConfig, fc, runId)
+	js.ArchiveCreated, err = artifact.MakeArtifactArchive(artifactDir, unencryptedArchiveTarget, getArchiveFormat(jobConfig, fc), getCompressionLevel(jobConfig, fc))
 	if err != nil {
 		js.Status = STATUS_FAILURE
 		js.Error = err.Error()
@@ -114,6 +237,20 @@ func Start(jobConfig config.JobConfig, runId string) JobStatus {
 		return js
 	}
 
+	if js.ArchiveCreated {
+		js.ArchivePath = archiveTarget
+	}
+
+	if js.ArchiveCreated && unencryptedArchiveTarget != archiveTarget {
+		err = encryptArchive(unencryptedArchiveTarget, archiveTarget, fc.Encryption)
+		if err != nil {
+			js.Status = STATUS_FAILURE
+			js.Error = err.Error()
+
+			return js
+		}
+	}
+
 	if js.ArchiveCreated {
 		fileInfo, err := os.Stat(archiveTarget)
 		if err != nil {
@@ -123,7 +260,220 @@ func Start(jobConfig config.JobConfig, runId string) JobStatus {
 			return js
 		}
 		js.ArchiveSize = fileInfo.Size()
+
+		js.ArchiveChecksum, err = checksumFile(archiveTarget)
+		if err != nil {
+			js.Status = STATUS_FAILURE
+			js.Error = err.Error()
+
+			return js
+		}
 	}
 
 	return js
 }
+
+// Get how many times a job's command and transfers should be retried and how long to wait before the first retry.
+func GetRetryPolicy(jobConfig config.JobConfig, fc config.FrostyConfig) (int, time.Duration) {
+	return jobConfig.GetRetries(fc.Retries), jobConfig.GetRetryBackoff(fc.RetryBackoff)
+}
+
+// Wait before making the given attempt again. The backoff is doubled after every attempt. Returns false if the
+// context was done before the wait was over, in which case there should be no further attempts.
+func WaitForRetry(ctx context.Context, retryBackoff time.Duration, attempt int) bool {
+	wait := retryBackoff << uint(attempt-1)
+
+	// Guard against the doubling overflowing after a large number of retries.
+	if wait < retryBackoff {
+		wait = retryBackoff
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// Run the job's command once, returning its status, any error and the trimmed output it wrote to stdout and stderr.
+func runJobCommand(ctx context.Context, jobConfig config.JobConfig, fc config.FrostyConfig, jobDir string, artifactDir string) (int, string, string, string) {
+	cmd := newJobCommand(jobConfig)
+	cmd.Env = getJobEnvironment(jobConfig, jobDir, artifactDir)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	timeout := jobConfig.GetTimeout(fc.JobTimeout)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := runCommand(ctx, cmd)
+
+	// Capture and trim any output, including errors logged to stderr. Secrets from the config file are redacted as the
+	// output ends up in logs, the run history and email reports.
+	stdoutText := config.Redact(strings.TrimSpace(stdout.String()))
+	stderrText := config.Redact(strings.TrimSpace(stderr.String()))
+
+	if err == context.DeadlineExceeded {
+		return STATUS_TIMEOUT, fmt.Sprintf("Job timed out after %s and was stopped.", timeout), stdoutText, stderrText
+	}
+	if err == context.Canceled {
+		return STATUS_INTERRUPTED, "Job was interrupted and stopped.", stdoutText, stderrText
+	}
+	if err != nil {
+		return STATUS_FAILURE, config.Redact(err.Error()), stdoutText, stderrText
+	}
+
+	// Stderr is only reported for failed commands.
+	return STATUS_SUCCESS, "", stdoutText, ""
+}
+
+// Check that a job's command can be found and is executable, returning the path it resolves to. Commands run through
+// the shell may contain anything the shell accepts so only the shell itself is checked.
+func CheckCommand(jobConfig config.JobConfig) (string, error) {
+	if jobConfig.WorkingDirectory != "" {
+		fi, err := os.Stat(jobConfig.WorkingDirectory)
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("the working directory %s is not a directory", jobConfig.WorkingDirectory)
+		}
+	}
+
+	cmd := newJobCommand(jobConfig)
+	name := cmd.Args[0]
+
+	// Commands given as a relative path are run from the working directory rather than frosty's own.
+	if strings.ContainsAny(name, "/"+string(filepath.Separator)) && !filepath.IsAbs(name) && cmd.Dir != "" {
+		name = filepath.Join(cmd.Dir, name)
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	if jobConfig.Shell {
+		return fmt.Sprintf("%s (the command line is run through the shell and not checked)", path), nil
+	}
+
+	return path, nil
+}
+
+// Build the command to run for a job, either executing it directly or through the shell.
+func newJobCommand(jobConfig config.JobConfig) *exec.Cmd {
+	var cmd *exec.Cmd
+	if jobConfig.Shell {
+		cmd = shellCommand(jobConfig.Name, jobConfig.Command, jobConfig.Args)
+	} else {
+		cmd = exec.Command(jobConfig.Command, jobConfig.Args...)
+	}
+	cmd.Dir = jobConfig.WorkingDirectory
+
+	return cmd
+}
+
+// Get the environment to run a job's command in. This is frosty's own environment, without any AWS credentials, with
+// the job's variables added, followed by the variables frosty sets so that these always take precedence.
+func getJobEnvironment(jobConfig config.JobConfig, jobDir string, artifactDir string) []string {
+	var env []string
+	for _, v := range os.Environ() {
+		if !isScrubbedEnvironmentVariable(v) {
+			env = append(env, v)
+		}
+	}
+
+	// Sort the job's variables so the environment is the same for every run.
+	var names []string
+	for name := range jobConfig.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		env = append(env, fmt.Sprintf("%s=%s", name, jobConfig.Env[name]))
+	}
+
+	env = append(env, fmt.Sprintf("FROSTY_JOB_DIR=%s", jobDir))
+	env = append(env, fmt.Sprintf("FROSTY_JOB_ARTIFACTS_DIR=%s", artifactDir))
+
+	return env
+}
+
+// Whether a variable in the form NAME=value should be kept out of job environments. Names are compared case
+// insensitively as they are on Windows.
+func isScrubbedEnvironmentVariable(v string) bool {
+	name := strings.SplitN(v, "=", 2)[0]
+	for _, sv := range SCRUBBED_ENVIRONMENT_VARIABLES {
+		if strings.EqualFold(name, sv) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove everything in the artifact directory, leaving it empty.
+func resetArtifactDirectory(artifactDir string) error {
+	err := os.RemoveAll(artifactDir)
+	if err != nil {
+		return err
+	}
+
+	return os.MkdirAll(artifactDir, 0755)
+}
+
+// Encrypt the archive and remove the unencrypted copy so that only the encrypted archive is left to be transferred.
+func encryptArchive(archivePath string, target string, encryption config.EncryptionConfig) error {
+	err := artifact.EncryptArtifactArchive(archivePath, target, encryption)
+	if err != nil {
+		return fmt.Errorf("Error encrypting archive:\n%s\n", err)
+	}
+
+	return os.Remove(archivePath)
+}
+
+// Run the command, stopping its whole process group if the context is done before it exits. The process group is
+// first asked to exit and then killed if it has not done so within the grace period. Returns the context's error if
+// the command was stopped. Output written after the command exits by processes it left running is not waited for.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	cmd.WaitDelay = JOB_OUTPUT_WAIT_DELAY
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if errors.Is(err, exec.ErrWaitDelay) {
+			log.Printf("%s exited but left processes running that still hold its output open, which has been closed\n", cmd.Path)
+			err = nil
+		}
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	terminateProcessGroup(cmd)
+
+	select {
+	case <-done:
+	case <-time.After(JOB_TERMINATION_GRACE_PERIOD):
+		killProcessGroup(cmd)
+		<-done
+	}
+
+	return ctx.Err()
+}
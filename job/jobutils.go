@@ -1,6 +1,9 @@
 package job
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"log"
 	"os"
 	"os/user"
@@ -8,15 +11,15 @@ import (
 
 	"fmt"
 
-	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/artifact"
 	"github.com/mleonard87/frosty/config"
 )
 
 const (
-	FROSTY_DIR_NAME                     = ".frosty"
-	JOBS_DIR_NAME                       = "jobs"
-	JOB_ARTIFACTS_DIR_NAME              = "artifacts"
-	ARTIFACT_ARCHIVE_FILENAME_EXTENSION = "zip"
+	FROSTY_DIR_NAME              = ".frosty"
+	JOBS_DIR_NAME                = "jobs"
+	JOB_ARTIFACTS_DIR_NAME       = "artifacts"
+	ENCRYPTED_FILENAME_EXTENSION = "enc"
 )
 
 func getUserHomeDirectory() string {
@@ -29,27 +32,31 @@ func getUserHomeDirectory() string {
 	return usr.HomeDir
 }
 
-func getRunDirectoryPath(runId string) string {
-	fc := config.GetFrostConfig()
+// Get frosty's working directory. This is the workDirectory in fc or ~/.frosty if one is not set.
+func GetWorkDirectoryPath(fc config.FrostyConfig) string {
 	if fc.WorkDir == "" {
 		userHome := getUserHomeDirectory()
-		return filepath.Join(userHome, FROSTY_DIR_NAME, JOBS_DIR_NAME, runId)
+		return filepath.Join(userHome, FROSTY_DIR_NAME)
 	} else {
-		return filepath.Join(fc.WorkDir, JOBS_DIR_NAME, runId)
+		return fc.WorkDir
 	}
 }
 
-func getJobDirectoryPath(jobName string, runId string) string {
-	return filepath.Join(getRunDirectoryPath(runId), jobName)
+func getRunDirectoryPath(fc config.FrostyConfig, runId string) string {
+	return filepath.Join(GetWorkDirectoryPath(fc), JOBS_DIR_NAME, runId)
 }
 
-func getJobArtifactDirectoryPath(jobName string, runId string) string {
-	return filepath.Join(getJobDirectoryPath(jobName, runId), JOB_ARTIFACTS_DIR_NAME)
+func getJobDirectoryPath(jobName string, fc config.FrostyConfig, runId string) string {
+	return filepath.Join(getRunDirectoryPath(fc, runId), jobName)
 }
 
-func MakeJobDirectories(jobName string, runId string) (string, string, error) {
-	jobDir := getJobDirectoryPath(jobName, runId)
-	artifactDir := getJobArtifactDirectoryPath(jobName, runId)
+func getJobArtifactDirectoryPath(jobName string, fc config.FrostyConfig, runId string) string {
+	return filepath.Join(getJobDirectoryPath(jobName, fc, runId), JOB_ARTIFACTS_DIR_NAME)
+}
+
+func MakeJobDirectories(jobName string, fc config.FrostyConfig, runId string) (string, string, error) {
+	jobDir := getJobDirectoryPath(jobName, fc, runId)
+	artifactDir := getJobArtifactDirectoryPath(jobName, fc, runId)
 
 	err := os.MkdirAll(jobDir, 0755)
 	if err != nil {
@@ -64,22 +71,81 @@ func MakeJobDirectories(jobName string, runId string) (string, string, error) {
 	return jobDir, artifactDir, nil
 }
 
-func RemoveJobDirectory(jobName string, runId string) error {
-	jobDir := getJobDirectoryPath(jobName, runId)
+func RemoveJobDirectory(jobName string, fc config.FrostyConfig, runId string) error {
+	jobDir := getJobDirectoryPath(jobName, fc, runId)
 	return os.RemoveAll(jobDir)
 }
 
-func RemoveRunDirectory(runId string) error {
-	runDir := getRunDirectoryPath(runId)
-	return os.RemoveAll(runDir)
+// Remove the directory created for a run of jobs. This fails if it is not empty so that no job's artifacts are lost.
+func RemoveRunDirectory(fc config.FrostyConfig, runId string) error {
+	runDir := getRunDirectoryPath(fc, runId)
+	return os.Remove(runDir)
+}
+
+func GetArtifactArchiveFileName(jobConfig config.JobConfig, fc config.FrostyConfig) string {
+	fileName := getUnencryptedArtifactArchiveFileName(jobConfig, fc)
+	if fc.Encryption.IsEnabled() {
+		fileName = fmt.Sprintf("%s.%s", fileName, ENCRYPTED_FILENAME_EXTENSION)
+	}
+	return fileName
+}
+
+func getUnencryptedArtifactArchiveFileName(jobConfig config.JobConfig, fc config.FrostyConfig) string {
+	return fmt.Sprintf("%s.%s", jobConfig.Name, getArchiveFormat(jobConfig, fc))
 }
 
-func GetArtifactArchiveFileName(jobName string) string {
-	bs := *backupservice.CurrentBackupService()
-	return fmt.Sprintf("%s.%s", bs.ArtifactFilename(jobName), ARTIFACT_ARCHIVE_FILENAME_EXTENSION)
+func GetArtifactArchiveTargetName(jobConfig config.JobConfig, fc config.FrostyConfig, runId string) string {
+	artifactDir := getJobArtifactDirectoryPath(jobConfig.Name, fc, runId)
+	return filepath.Join(artifactDir, GetArtifactArchiveFileName(jobConfig, fc))
 }
 
-func GetArtifactArchiveTargetName(jobName string, runId string) string {
-	artifactDir := getJobArtifactDirectoryPath(jobName, runId)
-	return filepath.Join(artifactDir, GetArtifactArchiveFileName(jobName))
+// Get the path to create the archive at before it is encrypted. This is the same as the target name if encryption is
+// not enabled.
+func getUnencryptedArtifactArchiveTargetName(jobConfig config.JobConfig, fc config.FrostyConfig, runId string) string {
+	artifactDir := getJobArtifactDirectoryPath(jobConfig.Name, fc, runId)
+	return filepath.Join(artifactDir, getUnencryptedArtifactArchiveFileName(jobConfig, fc))
+}
+
+// Get the format to archive a job's artifacts in. This is the job's own format if it has one, otherwise the global
+// format and finally zip if neither is set.
+func getArchiveFormat(jobConfig config.JobConfig, fc config.FrostyConfig) string {
+	if jobConfig.ArchiveFormat != "" {
+		return jobConfig.ArchiveFormat
+	}
+
+	if fc.ArchiveFormat != "" {
+		return fc.ArchiveFormat
+	}
+
+	return config.ARCHIVE_FORMAT_ZIP
+}
+
+// Get the level of compression to use when archiving a job's artifacts, in the same order of precedence as the format.
+func getCompressionLevel(jobConfig config.JobConfig, fc config.FrostyConfig) int {
+	if jobConfig.CompressionLevel != nil {
+		return *jobConfig.CompressionLevel
+	}
+
+	if fc.CompressionLevel != nil {
+		return *fc.CompressionLevel
+	}
+
+	return artifact.DEFAULT_COMPRESSION_LEVEL
+}
+
+// Get the hex encoded SHA-256 checksum of a file.
+func checksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
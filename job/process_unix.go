@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package job
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Build a command that runs the command line through /bin/sh. The job's name is given as $0 so any arguments are
+// available to the command line as $1, $2 and so on.
+func shellCommand(name string, command string, args []string) *exec.Cmd {
+	return exec.Command("/bin/sh", append([]string{"-c", command, name}, args...)...)
+}
+
+// Start the command in its own process group so that it and any processes it starts can be signalled together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Ask the command's process group to exit.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// Force the command's process group to exit.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package job
+
+import (
+	"os/exec"
+)
+
+// Build a command that runs the command line through cmd.exe. Any arguments are appended to the command line.
+func shellCommand(name string, command string, args []string) *exec.Cmd {
+	return exec.Command("cmd.exe", append([]string{"/C", command}, args...)...)
+}
+
+// Windows has no process groups that can be signalled so only the command itself is stopped.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// Windows has no equivalent of SIGTERM so the command is killed straight away.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,95 @@
+package prune
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+)
+
+// A rule of a retention policy. The rule keeps the newest archive in each of the most recent periods, up to count
+// periods, where an archive's period is given by its key.
+type retentionRule struct {
+	name  string
+	count int
+	key   func(a backupservice.Archive) string
+}
+
+// Decide which archives to keep under a grandfather-father-son retention policy. Every archive kept gives the rules
+// that kept it as the reason, e.g. "kept as daily 2017-01-30, weekly 2017-W05". Periods are in local time.
+func applyRetentionPolicy(d backupservice.Destination, archives []backupservice.Archive, policy config.RetentionPolicy) []Decision {
+	sorted := make([]backupservice.Archive, len(archives))
+	copy(sorted, archives)
+	sort.SliceStable(sorted, func(i, k int) bool {
+		return sorted[i].CreatedAt.After(sorted[k].CreatedAt)
+	})
+
+	rules := []retentionRule{
+		{"last", policy.KeepLast, func(a backupservice.Archive) string {
+			// Every archive is a period of its own.
+			return a.Key
+		}},
+		{"daily", policy.KeepDaily, func(a backupservice.Archive) string {
+			return a.CreatedAt.Local().Format("2006-01-02")
+		}},
+		{"weekly", policy.KeepWeekly, func(a backupservice.Archive) string {
+			year, week := a.CreatedAt.Local().ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", policy.KeepMonthly, func(a backupservice.Archive) string {
+			return a.CreatedAt.Local().Format("2006-01")
+		}},
+		{"yearly", policy.KeepYearly, func(a backupservice.Archive) string {
+			return a.CreatedAt.Local().Format("2006")
+		}},
+	}
+
+	reasons := make([][]string, len(sorted))
+
+	for _, r := range rules {
+		kept := 0
+		lastPeriod := ""
+
+		for i, a := range sorted {
+			if kept >= r.count {
+				break
+			}
+
+			// Archives are newest first so the first archive seen in each period is the newest in it.
+			period := r.key(a)
+			if period == lastPeriod {
+				continue
+			}
+			lastPeriod = period
+			kept++
+
+			if r.name == "last" {
+				reasons[i] = append(reasons[i], fmt.Sprintf("last %d", kept))
+			} else {
+				reasons[i] = append(reasons[i], fmt.Sprintf("%s %s", r.name, period))
+			}
+		}
+	}
+
+	var decisions []Decision
+
+	for i, a := range sorted {
+		decision := Decision{
+			Destination: d.Name,
+			Archive:     a,
+		}
+
+		if len(reasons[i]) > 0 {
+			decision.Reason = "kept as " + strings.Join(reasons[i], ", ")
+		} else {
+			decision.Delete = true
+			decision.Reason = "not kept by any rule of the retention policy"
+		}
+
+		decisions = append(decisions, decision)
+	}
+
+	return decisions
+}
@@ -0,0 +1,109 @@
+package prune
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+)
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	archive := func(year int, month time.Month, day int, hour int) backupservice.Archive {
+		createdAt := time.Date(year, month, day, hour, 0, 0, 0, time.Local)
+		return backupservice.Archive{
+			Key:       createdAt.Format("20060102150405"),
+			CreatedAt: createdAt,
+		}
+	}
+
+	// Two archives a day for the last few days of 2016 and all of January 2017. 2017-01-30 is a Monday.
+	var archives []backupservice.Archive
+	for d := time.Date(2016, 12, 28, 0, 0, 0, 0, time.Local); d.Before(time.Date(2017, 2, 1, 0, 0, 0, 0, time.Local)); d = d.AddDate(0, 0, 1) {
+		archives = append(archives, archive(d.Year(), d.Month(), d.Day(), 1), archive(d.Year(), d.Month(), d.Day(), 13))
+	}
+
+	tests := []struct {
+		name   string
+		policy config.RetentionPolicy
+		// The reason each archive kept was kept for, by key. Every other archive should be deleted.
+		kept map[string]string
+	}{
+		{
+			name:   "nothing",
+			policy: config.RetentionPolicy{},
+			kept:   map[string]string{},
+		},
+		{
+			name:   "last",
+			policy: config.RetentionPolicy{KeepLast: 3},
+			kept: map[string]string{
+				"20170131130000": "kept as last 1",
+				"20170131010000": "kept as last 2",
+				"20170130130000": "kept as last 3",
+			},
+		},
+		{
+			name:   "daily",
+			policy: config.RetentionPolicy{KeepDaily: 2},
+			kept: map[string]string{
+				"20170131130000": "kept as daily 2017-01-31",
+				"20170130130000": "kept as daily 2017-01-30",
+			},
+		},
+		{
+			name:   "weekly",
+			policy: config.RetentionPolicy{KeepWeekly: 3},
+			kept: map[string]string{
+				"20170131130000": "kept as weekly 2017-W05",
+				"20170129130000": "kept as weekly 2017-W04",
+				"20170122130000": "kept as weekly 2017-W03",
+			},
+		},
+		{
+			name:   "monthly and yearly",
+			policy: config.RetentionPolicy{KeepMonthly: 2, KeepYearly: 5},
+			kept: map[string]string{
+				"20170131130000": "kept as monthly 2017-01, yearly 2017",
+				"20161231130000": "kept as monthly 2016-12, yearly 2016",
+			},
+		},
+		{
+			name:   "more periods than archives",
+			policy: config.RetentionPolicy{KeepLast: 1, KeepDaily: 1, KeepWeekly: 1, KeepMonthly: 1, KeepYearly: 10},
+			kept: map[string]string{
+				"20170131130000": "kept as last 1, daily 2017-01-31, weekly 2017-W05, monthly 2017-01, yearly 2017",
+				"20161231130000": "kept as yearly 2016",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := backupservice.Destination{Name: "local"}
+			decisions := applyRetentionPolicy(d, archives, tt.policy)
+
+			if len(decisions) != len(archives) {
+				t.Fatalf("Got %d decisions for %d archives", len(decisions), len(archives))
+			}
+
+			kept := make(map[string]string)
+			for i, decision := range decisions {
+				if i > 0 && decision.Archive.CreatedAt.After(decisions[i-1].Archive.CreatedAt) {
+					t.Errorf("Decisions are not newest first: %s is after %s", decision.Archive.Key, decisions[i-1].Archive.Key)
+				}
+				if decision.Destination != d.Name {
+					t.Errorf("Decision for %s has destination %q, want %q", decision.Archive.Key, decision.Destination, d.Name)
+				}
+				if !decision.Delete {
+					kept[decision.Archive.Key] = decision.Reason
+				}
+			}
+
+			if !reflect.DeepEqual(kept, tt.kept) {
+				t.Errorf("Kept %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mleonard87/frosty/backup"
+	"github.com/mleonard87/frosty/config"
+	"github.com/mleonard87/frosty/history"
+	"github.com/mleonard87/frosty/job"
+)
+
+// Glacier charges for archives as though they were stored for at least this many days, even if they are deleted sooner.
+const GLACIER_MINIMUM_STORAGE_DAYS = 90
+
+// What a pruning pass decided to do with an archive, and why.
+type Decision struct {
+	Destination string
+	Archive     backupservice.Archive
+	Delete      bool
+	Reason      string
+	// Set if the archive was to be deleted but doing so failed.
+	Error string
+}
+
+// Delete the archives stored on this host for the given jobs that are no longer needed. Archives are kept according to
+// the job's retention policy if it has one, otherwise they are deleted once they are older than the job's retention
+// period. Without a retention policy S3 archives are left for the bucket's lifecycle rules to expire and any job with
+// a retention period of 0 days is left alone. Jobs without a retention policy of their own use the one in fc. If dryRun
+// is set nothing is deleted but the decisions that would have been made are still returned.
+func Prune(ctx context.Context, destinations []backupservice.Destination, jobs []config.JobConfig, fc config.FrostyConfig, dryRun bool) ([]Decision, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	workDir := job.GetWorkDirectoryPath(fc)
+	var decisions []Decision
+	failures := 0
+
+	for _, d := range destinations {
+		pbs, ok := d.BackupService.(backupservice.PrunableBackupService)
+		if !ok {
+			continue
+		}
+
+		for _, j := range jobs {
+			if !j.UsesDestination(d.Name) {
+				continue
+			}
+
+			policy := j.GetRetentionPolicy(fc.Retention)
+			retentionDays := j.GetRetentionDays(pbs.GetRetentionDays())
+			if policy == nil && (retentionDays == 0 || d.BackupService.Name() == config.BACKUP_SERVICE_AMAZON_S3) {
+				continue
+			}
+
+			archives, err := listArchives(ctx, d, workDir, hostname, j.Name)
+			if err != nil {
+				log.Printf("Error listing archives for %s in %s to prune:\n%s\n", j.Name, d.Name, err)
+				failures++
+				continue
+			}
+
+			var jobDecisions []Decision
+			if policy != nil {
+				jobDecisions = applyRetentionPolicy(d, archives, *policy)
+			} else {
+				for _, a := range archives {
+					jobDecisions = append(jobDecisions, applyRetentionDays(d, a, retentionDays))
+				}
+			}
+
+			for _, decision := range jobDecisions {
+				applyMinimumStorageDuration(d, &decision)
+
+				if decision.Delete && !dryRun {
+					err = deleteArchive(d, pbs, workDir, decision.Archive)
+					if err != nil {
+						decision.Error = err.Error()
+						failures++
+					}
+				}
+
+				decisions = append(decisions, decision)
+			}
+		}
+	}
+
+	if failures > 0 {
+		return decisions, fmt.Errorf("%d archive(s) or job(s) could not be pruned", failures)
+	}
+
+	return decisions, nil
+}
+
+// Decide whether an archive should be deleted because it is older than the retention period.
+func applyRetentionDays(d backupservice.Destination, a backupservice.Archive, retentionDays int64) Decision {
+	decision := Decision{
+		Destination: d.Name,
+		Archive:     a,
+	}
+
+	expiry := time.Now().AddDate(0, 0, -int(retentionDays))
+
+	if !a.CreatedAt.Before(expiry) {
+		decision.Reason = fmt.Sprintf("within the %d day retention period", retentionDays)
+		return decision
+	}
+
+	decision.Delete = true
+	decision.Reason = fmt.Sprintf("older than the %d day retention period", retentionDays)
+
+	return decision
+}
+
+// Glacier archives younger than its minimum storage duration are kept until they reach it unless early deletion is
+// allowed, in which case a warning is logged as this costs money.
+func applyMinimumStorageDuration(d backupservice.Destination, decision *Decision) {
+	agss, ok := d.BackupService.(*backupservice.AmazonGlacierBackupService)
+	if !ok || !decision.Delete {
+		return
+	}
+
+	age := time.Since(decision.Archive.CreatedAt)
+	if age >= GLACIER_MINIMUM_STORAGE_DAYS*24*time.Hour {
+		return
+	}
+
+	remainingDays := GLACIER_MINIMUM_STORAGE_DAYS - int(age.Hours()/24)
+
+	if !agss.AllowEarlyDeletion {
+		decision.Delete = false
+		decision.Reason += fmt.Sprintf(" but kept for another %d day(s) until Glacier's %d day minimum storage duration has passed", remainingDays, GLACIER_MINIMUM_STORAGE_DAYS)
+		return
+	}
+
+	log.Printf("Warning: deleting Glacier archive %s before Glacier's %d day minimum storage duration will incur an early deletion charge for the remaining %d day(s).\n", decision.Archive.Key, GLACIER_MINIMUM_STORAGE_DAYS, remainingDays)
+	decision.Reason += fmt.Sprintf(", deleted early incurring a charge for %d day(s)", remainingDays)
+}
+
+// List the archives stored in a destination for a job on this host. Listing Glacier vaults takes hours so the
+// archives recorded in the run history are used instead.
+func listArchives(ctx context.Context, d backupservice.Destination, workDir string, hostname string, jobName string) ([]backupservice.Archive, error) {
+	if d.BackupService.Name() != config.BACKUP_SERVICE_AMAZON_GLACIER {
+		return d.BackupService.ListArchives(ctx, hostname, jobName)
+	}
+
+	return history.ListJobArchives(workDir, d.Name, hostname, jobName)
+}
+
+// Delete an archive, recording the deletion in the run history so it is not considered again.
+func deleteArchive(d backupservice.Destination, pbs backupservice.PrunableBackupService, workDir string, a backupservice.Archive) error {
+	log.Printf("Removing expired backup %s from %s\n", a.Key, d.Name)
+
+	err := pbs.DeleteArchive(a)
+	if err != nil {
+		return err
+	}
+
+	err = history.MarkArchiveDeleted(workDir, d.Name, a.Container, a.Key, time.Now())
+	if err != nil {
+		log.Printf("Error recording the deletion of %s from %s in the history catalog:\n%s\n", a.Key, d.Name, err)
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package reporting
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"text/template"
@@ -13,22 +14,35 @@ import (
 )
 
 type EmailSummaryTemplateData struct {
+	Destinations []DestinationSummary
+	StartTime    time.Time
+	EndTime      time.Time
+	ElapsedTime  time.Duration
+	Hostname     string
+	Jobs         []job.JobStatus
+	Status       int
+}
+
+type DestinationSummary struct {
+	Name           string
 	BackupService  string
-	StartTime      time.Time
-	EndTime        time.Time
-	ElapsedTime    time.Duration
-	Hostname       string
 	BackupLocation string
-	Jobs           []job.JobStatus
-	Status         int
+}
+
+// Functions available to the email template.
+var templateFuncs = template.FuncMap{
+	// Used to number attempts from 1 when ranging over them.
+	"inc": func(i int) int {
+		return i + 1
+	},
 }
 
 func (estd EmailSummaryTemplateData) IsSuccessful() bool {
 	return estd.Status == job.STATUS_SUCCESS
 }
 
-func SendEmailSummary(jobStatuses []job.JobStatus, emailConfig *config.EmailReportingConfig) {
-	templateData := emailSummaryTemplateData(jobStatuses)
+func SendEmailSummary(jobStatuses []job.JobStatus, destinations []backupservice.Destination, emailConfig *config.EmailReportingConfig) {
+	templateData := emailSummaryTemplateData(jobStatuses, destinations)
 
 	data, err := tmpl.Asset("tmpl/email_summary.html")
 	if err != nil {
@@ -36,13 +50,34 @@ func SendEmailSummary(jobStatuses []job.JobStatus, emailConfig *config.EmailRepo
 		log.Println(err)
 	}
 
-	t := template.New("frosty-report")
+	t := template.New("frosty-report").Funcs(templateFuncs)
 	t, err2 := t.Parse(string(data))
 	if err2 != nil {
 		log.Printf("Error parsing \"tmpl/email_summary.html\" email template:\n")
 		log.Println(err)
 	}
 
+	mail := newMail(emailConfig)
+	mail.SendFromTemplate(t, templateData)
+}
+
+// Check that email reports can be sent by connecting and authenticating to the SMTP server, returning a description
+// of what was checked. Nothing is sent.
+func CheckEmail(emailConfig *config.EmailReportingConfig) (string, error) {
+	mail := newMail(emailConfig)
+
+	err := mail.Check()
+	if err != nil {
+		return "", err
+	}
+
+	if mail.useAuthentication() {
+		return fmt.Sprintf("connected to %s and authenticated as %s", mail.getSMTPHostAndPort(), mail.Username), nil
+	}
+	return fmt.Sprintf("connected to %s", mail.getSMTPHostAndPort()), nil
+}
+
+func newMail(emailConfig *config.EmailReportingConfig) Mail {
 	mail := Mail{
 		Host:     emailConfig.SMTP.Host,
 		Port:     emailConfig.SMTP.Port,
@@ -55,10 +90,10 @@ func SendEmailSummary(jobStatuses []job.JobStatus, emailConfig *config.EmailRepo
 		mail.AddRecipient(recipient)
 	}
 
-	mail.SendFromTemplate(t, templateData)
+	return mail
 }
 
-func emailSummaryTemplateData(jobStatuses []job.JobStatus) EmailSummaryTemplateData {
+func emailSummaryTemplateData(jobStatuses []job.JobStatus, destinations []backupservice.Destination) EmailSummaryTemplateData {
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Fatal("Could not determine hostname.", err)
@@ -76,21 +111,28 @@ func emailSummaryTemplateData(jobStatuses []job.JobStatus) EmailSummaryTemplateD
 			endTime = j.EndTime
 		}
 
-		if j.Status == job.STATUS_FAILURE {
+		if !j.IsSuccessful() {
 			status = job.STATUS_FAILURE
 		}
 	}
 
-	bs := *backupservice.CurrentBackupService()
+	var destinationSummaries []DestinationSummary
+
+	for _, d := range destinations {
+		destinationSummaries = append(destinationSummaries, DestinationSummary{
+			Name:           d.Name,
+			BackupService:  d.BackupService.Name(),
+			BackupLocation: d.BackupService.BackupLocation(),
+		})
+	}
 
 	return EmailSummaryTemplateData{
-		BackupService:  bs.Name(),
-		StartTime:      startTime,
-		EndTime:        endTime,
-		ElapsedTime:    endTime.Sub(startTime),
-		Hostname:       hostname,
-		BackupLocation: bs.BackupLocation(),
-		Jobs:           jobStatuses,
-		Status:         status,
+		Destinations: destinationSummaries,
+		StartTime:    startTime,
+		EndTime:      endTime,
+		ElapsedTime:  endTime.Sub(startTime),
+		Hostname:     hostname,
+		Jobs:         jobStatuses,
+		Status:       status,
 	}
 }
@@ -2,13 +2,21 @@ package reporting
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/smtp"
 	"strings"
 	"text/template"
+	"time"
+
+	"github.com/mleonard87/frosty/config"
 )
 
+// How long checking the SMTP server may take before it is treated as unreachable.
+const SMTP_CHECK_TIMEOUT = 30 * time.Second
+
 type Mail struct {
 	Host       string
 	Port       string
@@ -61,7 +69,10 @@ func (m *Mail) SendFromTemplate(tmpl *template.Template, templateData EmailSumma
 
 	wc.Write([]byte("\r\n"))
 
-	tmpl.Execute(&wc, templateData)
+	// Secrets from the config file may appear in job output so they are redacted from the body.
+	var body bytes.Buffer
+	tmpl.Execute(&body, templateData)
+	wc.WriteString(config.Redact(body.String()))
 
 	if m.useAuthentication() {
 		a := smtp.PlainAuth("", m.Username, m.Password, m.Host)
@@ -91,3 +102,35 @@ func (m *Mail) SendFromTemplate(tmpl *template.Template, templateData EmailSumma
 		cwc.Write(wc.Bytes())
 	}
 }
+
+// Connect to the SMTP server and authenticate in the same way as when sending, without sending anything.
+func (m *Mail) Check() error {
+	conn, err := net.DialTimeout("tcp", m.getSMTPHostAndPort(), SMTP_CHECK_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SMTP_CHECK_TIMEOUT))
+
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: m.Host})
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.useAuthentication() {
+		err = c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.Quit()
+}